@@ -8,7 +8,7 @@ import (
     "database/sql"
 )
 
-// Alias of map[string]interface{}
+// Alias of map[string]interface{}, NULL is nil
 type Item map[string]interface{}
 
 // Alias of []map[string]interface{}
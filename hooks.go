@@ -0,0 +1,46 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+// Hooks of Model entity operations, implemented by the entity type.
+// m runs its queries in the same transaction as the operation, if any.
+// An error aborts the operation; an After hook error is returned after the
+// write, which is rolled back only when the operation runs in a transaction,
+// see Model.Transaction.
+
+// Called by Create before insert
+type BeforeInserter interface {
+	BeforeInsert(m *Model) error
+}
+
+// Called by Create after insert, generated keys are set
+type AfterInserter interface {
+	AfterInsert(m *Model) error
+}
+
+// Called by Save before update
+type BeforeUpdater interface {
+	BeforeUpdate(m *Model) error
+}
+
+// Called by Save after update
+type AfterUpdater interface {
+	AfterUpdate(m *Model) error
+}
+
+// Called by Remove before delete
+type BeforeDeleter interface {
+	BeforeDelete(m *Model) error
+}
+
+// Called by Remove after delete
+type AfterDeleter interface {
+	AfterDelete(m *Model) error
+}
+
+// Called by Find after the entity is scanned
+type AfterFinder interface {
+	AfterFind(m *Model) error
+}
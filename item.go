@@ -0,0 +1,123 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Scan target of a db:",json" field, NULL leaves the zero value
+type jsonScanner struct {
+	v reflect.Value
+}
+
+// Scan implements sql.Scanner
+func (j jsonScanner) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("can not unmarshal %T into %s", src, j.v.Type())
+	}
+
+	p := reflect.New(j.v.Type())
+	if err := json.Unmarshal(b, p.Interface()); err != nil {
+		return err
+	}
+	j.v.Set(p.Elem())
+	return nil
+}
+
+// Convert map with string keys or struct to Item.
+// Struct fields are keyed by column name, db:",json" fields are marshaled to
+// a JSON string (nil is NULL), other values like driver.Valuer are left to
+// database/sql. Nested structs and fields under a nil embedded pointer are skipped.
+func toItem(d interface{}) (Item, error) {
+	switch v := d.(type) {
+	case Item:
+		return v, nil
+	case Where:
+		return Item(v), nil
+	case map[string]interface{}:
+		return Item(v), nil
+	}
+
+	val := reflect.ValueOf(d)
+	for val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+	if val.Kind() == reflect.Map && val.Type().Key().Kind() == reflect.String {
+		item := make(Item, val.Len())
+		for _, k := range val.MapKeys() {
+			item[k.String()] = val.MapIndex(k).Interface()
+		}
+		return item, nil
+	}
+	if val.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%T is not a map or struct", d)
+	}
+
+	item := make(Item)
+	for _, f := range structFields(val.Type()) {
+		if f.Nested {
+			continue
+		}
+
+		fv, ok := fieldValue(val, f.Index)
+		if !ok {
+			continue
+		}
+
+		if !isJSON(f.Options) {
+			item[f.Column] = fv.Interface()
+			continue
+		}
+
+		v, err := jsonValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+		item[f.Column] = v
+	}
+	return item, nil
+}
+
+// JSON text of v, nil pointer, map, slice or interface is NULL.
+// A string is used for all dialects, PostgreSQL casts it to json and jsonb.
+func jsonValue(v reflect.Value) (interface{}, error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+	}
+
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Field by index without allocating, false if a pointer on the way is nil
+func fieldValue(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
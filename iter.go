@@ -0,0 +1,161 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Iterator over result rows, only the current row is held in memory.
+//
+//	it, err := q.Iter()
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		if err := it.Scan(&u); err != nil {
+//			return err
+//		}
+//	}
+//	return it.Err()
+type Iter struct {
+	// Server
+	server *Server
+
+	// Result rows
+	rows *sql.Rows
+
+	// Result columns
+	columns []string
+
+	// Database type name of each column
+	types []string
+
+	// Row scanner of last Scan target type
+	scanner *rowScanner
+
+	// Target type of scanner
+	scannerType reflect.Type
+
+	// Called with each scanned ptr, snapshots entities of a tracked model
+	track func(ptr interface{}) error
+
+	// First error
+	err error
+}
+
+// Advance to the next row, false at the end or on error. Rows are closed at the end.
+func (it *Iter) Next() bool {
+	if it.err != nil || it.rows == nil {
+		return false
+	}
+
+	if it.rows.Next() {
+		return true
+	}
+
+	it.err = it.rows.Err()
+	it.Close()
+	return false
+}
+
+// Scan the current row into ptr: pointer to struct, map, slice or scalar
+func (it *Iter) Scan(ptr interface{}) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.rows == nil {
+		return errors.New("iterator is closed")
+	}
+
+	typ := reflect.TypeOf(ptr)
+	if it.scanner == nil || typ != it.scannerType {
+		s, err := newRowScanner(ptr, it.columns, it.types, false, it.server.IgnoreUnknownColumns, it.server.StrictNull)
+		if err != nil {
+			return err
+		}
+		it.scanner = s
+		it.scannerType = typ
+	}
+
+	if err := it.rows.Scan(it.scanner.targets()...); err != nil {
+		return err
+	}
+
+	v, err := it.scanner.value()
+	if err != nil {
+		return err
+	}
+	reflect.ValueOf(ptr).Elem().Set(v)
+	if it.track != nil {
+		return it.track(ptr)
+	}
+	return nil
+}
+
+// Error met during iteration
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// Close rows, safe to call more than once
+func (it *Iter) Close() error {
+	if it.rows == nil {
+		return nil
+	}
+
+	err := it.rows.Close()
+	it.rows = nil
+	return err
+}
+
+// Call fn, a func(T) error or func(*T) error, with each row scanned into a
+// new T, stop at the first error
+func (it *Iter) Each(fn interface{}) error {
+	defer it.Close()
+
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func || f.IsNil() || f.Type().NumIn() != 1 || f.Type().NumOut() != 1 || f.Type().Out(0) != errorType {
+		return fmt.Errorf("fn must be a func(T) error or func(*T) error, not %T", fn)
+	}
+
+	typ := f.Type().In(0)
+	ptr := typ.Kind() == reflect.Ptr
+	if ptr {
+		typ = typ.Elem()
+	}
+
+	for it.Next() {
+		v := reflect.New(typ)
+		if err := it.Scan(v.Interface()); err != nil {
+			return err
+		}
+		if !ptr {
+			v = v.Elem()
+		}
+		if err, _ := f.Call([]reflect.Value{v})[0].Interface().(error); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// New iterator
+func (e *Server) iter(ctx context.Context, p queryer, sql string, args []interface{}) (*Iter, error) {
+	rows, columns, types, err := e.rows(ctx, p, sql, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Iter{server: e, rows: rows, columns: columns, types: types}, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package db
+
+import (
+	"iter"
+)
+
+// Range over rows scanned into ptr, yield row number and error.
+// Rows are closed when the loop ends, also on break.
+//
+//	for i, err := range q.All(&u) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(i, u.Nickname)
+//	}
+func (q *Query) All(ptr interface{}) iter.Seq2[int, error] {
+	return func(yield func(int, error) bool) {
+		it, err := q.Iter()
+		if err != nil {
+			yield(0, err)
+			return
+		}
+		defer it.Close()
+
+		i := 0
+		for it.Next() {
+			if !yield(i, it.Scan(ptr)) {
+				return
+			}
+			i++
+		}
+
+		if err := it.Err(); err != nil {
+			yield(i, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package db
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestAll(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    s := qt.Query.Server
+
+    q := s.InsertInto("passport_user").Fields("UserID", "CreationTime", "BirthYear", "Gender", "Nickname")
+    for i := 0; i < 3; i++ {
+        q.Values(1000000+i, "2015-01-17 00:00:00", 1980+i, "Male", fmt.Sprintf("User%d", i))
+    }
+    if _, err := q.Exec(); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+
+    u := struct {
+        UserID   int64
+        Nickname string
+    }{}
+
+    // Break closes rows
+    n := 0
+    for i, err := range s.Select("UserID", "Nickname").From("passport_user").OrderAsc("UserID").All(&u) {
+        if err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+        if i == 1 {
+            break
+        }
+        n++
+    }
+    if n != 1 || u.Nickname != "User1" {
+        t.Fatalf("[%s]: %d %v\n", s.Type, n, u)
+    }
+    if st := dbObjects[s.DSN].Stats(); st.InUse != 0 {
+        t.Fatalf("[%s]: %d connections in use\n", s.Type, st.InUse)
+    }
+}
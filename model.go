@@ -4,7 +4,38 @@
 
 package db
 
-import ()
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Base error of StaleObjectError, for errors.Is
+var ErrStaleObject = errors.New("stale object")
+
+// Entity was updated or deleted since it was read: no row has its
+// primary key and version
+type StaleObjectError struct {
+	// Table name
+	Table string
+
+	// Primary key
+	Key Where
+
+	// Version of entity
+	Version interface{}
+}
+
+// Error message
+func (e *StaleObjectError) Error() string {
+	return fmt.Sprintf("stale object: table %s, key %v, version %v", e.Table, e.Key, e.Version)
+}
+
+// Is ErrStaleObject
+func (e *StaleObjectError) Is(target error) bool {
+	return target == ErrStaleObject
+}
 
 // Model struct
 type Model struct {
@@ -13,29 +44,159 @@ type Model struct {
 
 	// table instance
 	Table *Table
+
+	// If assigned, queries run in this transaction. optional.
+	Tx *Tx
+
+	// Soft deleted rows are selected and deleted for real
+	unscoped bool
+
+	// Snapshots of tracked entities, nil if the model is not tracked
+	snapshots *snapshots
+
+	// Named scopes, applied by Query.Scope
+	scopes map[string]Scope
+
+	// Scopes applied to every select, update and delete
+	defaultScopes []Scope
+}
+
+// Register named scope s, applied by m.Select().Scope(name)
+func (m *Model) AddScope(name string, s Scope) *Model {
+	if m.scopes == nil {
+		m.scopes = make(map[string]Scope)
+	}
+	m.scopes[name] = s
+	return m
+}
+
+// Register a scope applied to every select, update and delete of the model,
+// except those of Unscoped
+func (m *Model) AddDefaultScope(s Scope) *Model {
+	m.defaultScopes = append(m.defaultScopes, s)
+	return m
+}
+
+// Copy of model that selects soft deleted rows, deletes for real and
+// leaves out default scopes
+func (m *Model) Unscoped() *Model {
+	c := *m
+	c.unscoped = true
+	return &c
+}
+
+// Select, including soft deleted rows
+func (m *Model) WithTrashed(f ...string) *Query {
+	q := m.Unscoped().Select(f...)
+	m.applyDefaultScopes(q)
+	return q
+}
+
+// Select soft deleted rows only
+func (m *Model) OnlyTrashed(f ...string) *Query {
+	q := m.Unscoped().Select(f...)
+	if c, ok := m.Table.softDelete(); ok {
+		q.DefaultWhere(fmt.Sprintf("%s IS NOT NULL", q.quoteField(c.Name)))
+	}
+	m.applyDefaultScopes(q)
+	return q
+}
+
+// Undo soft delete of entity
+func (m *Model) Restore(entity interface{}) error {
+	if err := m.checkEntity(entity, false); err != nil {
+		return err
+	}
+
+	c, ok := m.Table.softDelete()
+	if !ok {
+		return fmt.Errorf("table %s has no softdelete column", m.Table.Name)
+	}
+
+	w, _, err := m.Table.primaryWhere(entity)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.softDelete(c, nil).Exec(w); err != nil {
+		return err
+	}
+
+	if v := reflect.ValueOf(entity); v.Kind() == reflect.Ptr {
+		f := fieldByIndex(v.Elem(), c.index)
+		f.Set(reflect.Zero(f.Type()))
+	}
+	return nil
+}
+
+// Copy of model running in tx
+func (m *Model) WithTx(tx *Tx) *Model {
+	c := *m
+	c.Tx = tx
+	return &c
+}
+
+// Run fn in a transaction with a copy of model, commit if fn returns nil,
+// otherwise rollback. Hook errors returned by fn roll back the transaction.
+func (m *Model) Transaction(fn func(m *Model) error) error {
+	if m.Tx != nil {
+		return fn(m)
+	}
+	s := Servers[m.Module]
+	if s == nil {
+		return errors.New("DB config not found")
+	}
+	return s.Transaction(func(tx *Tx) error {
+		return fn(m.WithTx(tx))
+	})
 }
 
 // Insert
 func (m *Model) Insert() *Query {
-	q := NewQuery(Servers[m.Module])
-	q.Table = m.Table
+	q := m.newQuery()
 	q.InsertInto(m.Table.Name)
 	return q
 }
 
 // Update
 func (m *Model) Update() *Query {
-	q := NewQuery(Servers[m.Module])
-	q.Table = m.Table
+	q := m.newQuery()
 	q.Update(m.Table.Name)
+	m.applyDefaultScopes(q)
 	return q
 }
 
-// Delete
+// Delete. With a softdelete column it is an update setting the column to the
+// current time on rows not yet deleted, unless the model is Unscoped.
 func (m *Model) Delete() *Query {
-	q := NewQuery(Servers[m.Module])
-	q.Table = m.Table
-	q.DeleteFrom(m.Table.Name)
+	c, ok := m.Table.softDelete()
+	if !ok || m.unscoped {
+		q := m.newQuery()
+		q.DeleteFrom(m.Table.Name)
+		m.applyDefaultScopes(q)
+		return q
+	}
+
+	typ := c.Type
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	now, ok := timestamp(typ, m.Table.now())
+	if !ok {
+		now = m.Table.now()
+	}
+	q := m.softDelete(c, now)
+	q.DefaultWhere(fmt.Sprintf("%s IS NULL", q.quoteField(c.Name)))
+	return q
+}
+
+// Update setting softdelete column c to v and updated columns to the current time
+func (m *Model) softDelete(c Column, v interface{}) *Query {
+	d := Item{c.Name: v}
+	m.Table.touchItem(d, false)
+
+	q := m.Update()
+	q.mapToUpdate(d)
 	return q
 }
 
@@ -45,13 +206,319 @@ func (m *Model) Select(f ...string) *Query {
 		f = m.Table.SelectFields
 	}
 
-	q := NewQuery(Servers[m.Module])
-	q.Table = m.Table
+	q := m.newQuery()
 	q.Select(f...)
 	q.From(m.Table.Name)
+
+	if c, ok := m.Table.softDelete(); ok && !m.unscoped {
+		q.DefaultWhere(fmt.Sprintf("%s IS NULL", q.quoteField(c.Name)))
+	}
+	m.applyDefaultScopes(q)
+	return q
+}
+
+// Apply default scopes to q, unless the model is Unscoped
+func (m *Model) applyDefaultScopes(q *Query) {
+	if m.unscoped {
+		return
+	}
+	for _, s := range m.defaultScopes {
+		q.applyScope(s)
+	}
+}
+
+// New query on table, in transaction if assigned
+func (m *Model) newQuery() *Query {
+	q := NewQuery(Servers[m.Module])
+	q.Table = m.Table
+	q.Tx = m.Tx
+	q.scopes = m.scopes
+	q.snapshots = m.snapshots
 	return q
 }
 
+// Insert entity, a pointer to Table.EntityType. AddFields are inserted, all
+// fields if nil. Generated keys are written back to zero primary key fields,
+// created and updated columns are set to the current time, a zero version to 1.
+// If the insert fails or BeforeInsert aborts it, entity is left as it was.
+func (m *Model) Create(entity interface{}) error {
+	if err := m.checkEntity(entity, true); err != nil {
+		return err
+	}
+
+	restore := keep(entity)
+	m.Table.touch(entity, true)
+	if _, v, ok := m.Table.version(entity); ok && v.IsZero() {
+		addInt(v, 1)
+	}
+
+	if h, ok := entity.(BeforeInserter); ok {
+		if err := h.BeforeInsert(m); err != nil {
+			restore()
+			return err
+		}
+	}
+
+	d, err := m.Table.insertItem(entity)
+	if err != nil {
+		restore()
+		return err
+	}
+
+	q := m.Insert()
+	q.SetPrimary(m.Table.primaries()...) // PostgreSQL compatibility
+	r, err := q.Exec(d)
+	if err != nil {
+		restore()
+		return err
+	}
+
+	m.Table.setKeys(entity, r.Keys)
+	if err := m.track(entity); err != nil {
+		return err
+	}
+
+	if h, ok := entity.(AfterInserter); ok {
+		return h.AfterInsert(m)
+	}
+	return nil
+}
+
+// Insert entity if its primary key is zero or no row has it, otherwise update
+// UpdateFields, or all fields if nil, by primary key.
+//
+// With a version column, the row is updated only if it still has the version
+// of entity, and the version is incremented. Otherwise the error is a
+// *StaleObjectError, errors.Is(err, ErrStaleObject).
+//
+// On a tracked model, an entity with a snapshot is updated in the changed
+// columns only, nothing is executed if none changed.
+//
+// Rows hidden by default scopes are not updated: Save inserts the entity, or
+// returns sql.ErrNoRows if it has a snapshot. Soft deleted rows are updated.
+//
+// If the update fails or BeforeUpdate aborts it, entity is left as it was.
+func (m *Model) Save(entity interface{}) error {
+	if err := m.checkEntity(entity, true); err != nil {
+		return err
+	}
+
+	w, zero, err := m.Table.primaryWhere(entity)
+	if err != nil {
+		return err
+	}
+	if zero {
+		return m.Create(entity)
+	}
+
+	// A key set by the client may have no row yet, a tracked entity has one
+	snap, tracked := m.snapshot(entity)
+	if !tracked {
+		ok, err := m.exists(w)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return m.Create(entity)
+		}
+	}
+
+	if tracked {
+		d, err := m.Table.updateItem(entity)
+		if err != nil {
+			return err
+		}
+		if len(changed(d, snap)) == 0 {
+			return nil
+		}
+	}
+
+	restore := keep(entity)
+	m.Table.touch(entity, false)
+
+	if h, ok := entity.(BeforeUpdater); ok {
+		if err := h.BeforeUpdate(m); err != nil {
+			restore()
+			return err
+		}
+	}
+
+	d, err := m.Table.updateItem(entity)
+	if err != nil {
+		restore()
+		return err
+	}
+	if tracked {
+		d = changed(d, snap)
+	}
+
+	c, v, locked := m.Table.version(entity)
+	switch {
+	case !locked && len(d) > 0:
+		r, err := m.Update().Exec(d, w)
+		if err != nil {
+			restore()
+			return err
+		}
+
+		// MySQL counts changed rows only, a row with the same values still exists
+		if r.RowsAffected == 0 {
+			ok, err := m.exists(w)
+			if err == nil && !ok {
+				err = sql.ErrNoRows
+			}
+			if err != nil {
+				restore()
+				return err
+			}
+		}
+	case locked:
+		// The version is only incremented, even if UpdateFields name it
+		delete(d, c.Name)
+		q := m.Update()
+		q.mapToUpdate(d)
+		inc := fmt.Sprintf("%s = %s + 1", q.quoteField(c.Name), q.quoteField(c.Name))
+		if len(d) == 0 {
+			q.Sql["Set"] = fmt.Sprintf(" SET %s ", inc)
+		} else {
+			q.Sql["Set"] += fmt.Sprintf(" , %s ", inc)
+		}
+
+		key := make(Where, len(w))
+		for k, x := range w {
+			key[k] = x
+		}
+		w[c.Name] = v.Interface()
+		q.mapToWhere(w)
+
+		r, err := q.Exec()
+		if err != nil {
+			restore()
+			return err
+		}
+		if r.RowsAffected == 0 {
+			restore()
+			return &StaleObjectError{Table: m.Table.Name, Key: key, Version: v.Interface()}
+		}
+		addInt(v, 1)
+	}
+	if err := m.track(entity); err != nil {
+		return err
+	}
+
+	if h, ok := entity.(AfterUpdater); ok {
+		return h.AfterUpdate(m)
+	}
+	return nil
+}
+
+// Whether a row has primary key w, under the scoping of Update
+func (m *Model) exists(w Where) (bool, error) {
+	q := m.WithTrashed()
+	q.mapToWhere(w)
+	return q.Exists()
+}
+
+// Get entity by primary key into ptr, sql.ErrNoRows if not found.
+// Values of a composite key are given in key order.
+func (m *Model) Find(ptr interface{}, pk ...interface{}) error {
+	if err := m.checkEntity(ptr, true); err != nil {
+		return err
+	}
+
+	w, err := m.Table.keyWhere(pk)
+	if err != nil {
+		return err
+	}
+
+	it, err := m.Select().Limit(0, 1).Iter(w)
+	if err != nil {
+		return err
+	}
+
+	if !it.Next() {
+		if err := it.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	err = it.Scan(ptr)
+	it.Close()
+	if err != nil {
+		return err
+	}
+
+	if h, ok := ptr.(AfterFinder); ok {
+		return h.AfterFind(m)
+	}
+	return nil
+}
+
+// Delete entity by primary key. Hooks of an entity passed by value run on a copy.
+func (m *Model) Remove(entity interface{}) error {
+	if err := m.checkEntity(entity, false); err != nil {
+		return err
+	}
+
+	w, _, err := m.Table.primaryWhere(entity)
+	if err != nil {
+		return err
+	}
+
+	e := entityPtr(entity)
+	if h, ok := e.(BeforeDeleter); ok {
+		if err := h.BeforeDelete(m); err != nil {
+			return err
+		}
+	}
+
+	if _, err = m.Delete().Exec(w); err != nil {
+		return err
+	}
+	m.Forget(entity)
+
+	if h, ok := e.(AfterDeleter); ok {
+		return h.AfterDelete(m)
+	}
+	return nil
+}
+
+// Entity must be Table.EntityType, or a pointer to it
+func (m *Model) checkEntity(entity interface{}, ptr bool) error {
+	t := reflect.TypeOf(entity)
+	if t != nil && t.Kind() == reflect.Ptr && !reflect.ValueOf(entity).IsNil() {
+		t = t.Elem()
+	} else if ptr {
+		return fmt.Errorf("entity must be a pointer to %s", m.Table.EntityType)
+	}
+
+	if t != m.Table.EntityType {
+		return fmt.Errorf("entity is %s, not %s", t, m.Table.EntityType)
+	}
+	return nil
+}
+
+// Pointer to entity, to a copy if it is not a pointer
+func entityPtr(entity interface{}) interface{} {
+	v := reflect.ValueOf(entity)
+	if v.Kind() == reflect.Ptr {
+		return entity
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Interface()
+}
+
+// Copy of entity, a pointer; the returned func puts it back
+func keep(entity interface{}) func() {
+	v := reflect.ValueOf(entity).Elem()
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	return func() {
+		v.Set(c)
+	}
+}
+
 // New Model
 func NewModel(module string, table *Table) Model {
 	return Model{Module: module, Table: table}
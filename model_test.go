@@ -0,0 +1,686 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+type modelUser struct {
+    UserID       int64 `pk:"true"`
+    CreationTime string
+    BirthYear    int64
+    Gender       string
+    Nickname     string
+}
+
+func TestModel(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    Servers["passport"] = qt.Query.Server
+    defer delete(Servers, "passport")
+
+    m := NewModel("passport", NewTable("passport_user", modelUser{}))
+
+    // Create writes back the id
+    u := modelUser{CreationTime: "2015-01-17 00:00:00", BirthYear: 1980, Gender: "Male", Nickname: "Bob"}
+    if err := m.Create(&u); err != nil || u.UserID != 1000000 {
+        t.Fatalf("Create: %d %v\n", u.UserID, err)
+    }
+    if err := m.Create(u); err == nil {
+        t.Fatalf("Create: entity must be a pointer\n")
+    }
+
+    // Save inserts a new entity, updates an existing one
+    a := modelUser{CreationTime: "2015-01-17 01:00:00", BirthYear: 1986, Gender: "Female", Nickname: "Alice"}
+    if err := m.Save(&a); err != nil || a.UserID != 1000001 {
+        t.Fatalf("Save: %d %v\n", a.UserID, err)
+    }
+    u.Nickname = "Bobby"
+    if err := m.Save(&u); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+
+    // UpdateFields limits the update
+    m.Table.UpdateFields = []string{"BirthYear"}
+    u.BirthYear = 1981
+    u.Nickname = "Robert"
+    if err := m.Save(&u); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+    m.Table.UpdateFields = nil
+
+    r := modelUser{}
+    if err := m.Find(&r, 1000000); err != nil || r.Nickname != "Bobby" || r.BirthYear != 1981 {
+        t.Fatalf("Find: %v %v\n", r, err)
+    }
+
+    // Remove
+    if err := m.Remove(u); err != nil {
+        t.Fatalf("Remove: %v\n", err)
+    }
+    if err := m.Find(&r, 1000000); err != sql.ErrNoRows {
+        t.Fatalf("Find: %v\n", err)
+    }
+
+    // Save inserts an entity whose key has no row
+    c := modelUser{UserID: 2000000, CreationTime: "2015-01-17 02:00:00", BirthYear: 1990, Gender: "Male", Nickname: "Carol"}
+    if err := m.Save(&c); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+    if err := m.Find(&r, 2000000); err != nil || r.Nickname != "Carol" {
+        t.Fatalf("Find: %v %v\n", r, err)
+    }
+}
+
+type userRole struct {
+    UserID int64 `db:",pk"`
+    RoleID int64 `db:",pk"`
+    Note   string
+}
+
+func TestModelCompositeKey(t *testing.T) {
+    s := NewServer("sqlite3", "sqlite3.db")
+    for _, v := range []string{`DROP TABLE IF EXISTS "user_role"`, `CREATE TABLE "user_role" ("UserID" INTEGER NOT NULL, "RoleID" INTEGER NOT NULL, "Note" TEXT NOT NULL, PRIMARY KEY ("UserID", "RoleID"))`} {
+        if _, err := s.Exec(v); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+    Servers["passport"] = s
+    defer delete(Servers, "passport")
+
+    m := NewModel("passport", NewTable("user_role", userRole{}))
+    if m.Table.Primary != "UserID" || len(m.Table.Primaries) != 2 || len(m.Table.Fields) != 1 {
+        t.Fatalf("Table: %#v\n", m.Table)
+    }
+
+    // Save inserts rows that do not exist, then updates them
+    for _, v := range []userRole{{1, 1, "a"}, {1, 2, "b"}, {2, 1, "c"}} {
+        if err := m.Save(&v); err != nil {
+            t.Fatalf("Save: %v\n", err)
+        }
+    }
+    r := userRole{1, 2, "B"}
+    if err := m.Save(&r); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+
+    r = userRole{}
+    if err := m.Find(&r, 1, 2); err != nil || r.Note != "B" {
+        t.Fatalf("Find: %v %v\n", r, err)
+    }
+    if err := m.Find(&r, 1); err == nil {
+        t.Fatalf("Find: one value for a composite key must be an error\n")
+    }
+
+    // Remove deletes one row only
+    if err := m.Remove(&r); err != nil {
+        t.Fatalf("Remove: %v\n", err)
+    }
+    n, err := m.Select().Count()
+    if err != nil || n != 2 {
+        t.Fatalf("Count: %d %v\n", n, err)
+    }
+
+    // Insert returns the key
+    q := m.Insert()
+    q.SetPrimary(m.Table.Primaries...)
+    res, err := q.Exec(Item{"UserID": 3, "RoleID": 1, "Note": "d"})
+    if err != nil || res.Keys["UserID"] != 3 || res.Keys["RoleID"] != 1 {
+        t.Fatalf("Insert: %#v %v\n", res.Keys, err)
+    }
+}
+
+type hookUser struct {
+    UserID       int64 `pk:"true"`
+    CreationTime string
+    BirthYear    int64
+    Gender       string
+    Nickname     string
+    Found        bool `db:"-"`
+}
+
+func (u *hookUser) BeforeInsert(m *Model) error {
+    u.Nickname = strings.TrimSpace(u.Nickname)
+    if u.Nickname == "" {
+        return fmt.Errorf("nickname is empty")
+    }
+    return nil
+}
+
+func (u *hookUser) AfterInsert(m *Model) error {
+    if u.Nickname == "Mallory" {
+        return fmt.Errorf("%d is not allowed", u.UserID)
+    }
+    return nil
+}
+
+func (u *hookUser) BeforeUpdate(m *Model) error {
+    return u.BeforeInsert(m)
+}
+
+func (u *hookUser) BeforeDelete(m *Model) error {
+    q := m.Select()
+    n, err := q.Where(q.Eq("Gender", u.Gender)).Count()
+    if err == nil && n < 2 {
+        err = fmt.Errorf("last %s user", u.Gender)
+    }
+    return err
+}
+
+func (u *hookUser) AfterFind(m *Model) error {
+    u.Found = true
+    return nil
+}
+
+func TestModelHooks(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    Servers["passport"] = qt.Query.Server
+    defer delete(Servers, "passport")
+
+    m := NewModel("passport", NewTable("passport_user", hookUser{}))
+
+    u := hookUser{CreationTime: "2015-01-17 00:00:00", BirthYear: 1980, Gender: "Male", Nickname: " Bob "}
+    if err := m.Create(&u); err != nil || u.Nickname != "Bob" {
+        t.Fatalf("Create: %v %v\n", u, err)
+    }
+    e := hookUser{CreationTime: "2015-01-17 00:00:00", BirthYear: 1980, Gender: "Male", Nickname: " "}
+    if err := m.Create(&e); err == nil || e.UserID != 0 {
+        t.Fatalf("Create: BeforeInsert must abort\n")
+    }
+    u.Nickname = ""
+    if err := m.Save(&u); err == nil {
+        t.Fatalf("Save: BeforeUpdate must abort\n")
+    }
+
+    // AfterInsert error rolls back the transaction
+    err := m.Transaction(func(m *Model) error {
+        return m.Create(&hookUser{CreationTime: "2015-01-17 00:00:00", BirthYear: 1980, Gender: "Male", Nickname: "Mallory"})
+    })
+    if err == nil {
+        t.Fatalf("Transaction: AfterInsert must fail\n")
+    }
+    if n, _ := m.Select().Count(); n != 1 {
+        t.Fatalf("Transaction: %d rows\n", n)
+    }
+    nm := NewModel("nomodule", m.Table)
+    if err := nm.Transaction(func(m *Model) error { return nil }); err == nil {
+        t.Fatalf("Transaction: module is not configured\n")
+    }
+
+    r := hookUser{}
+    if err := m.Find(&r, u.UserID); err != nil || !r.Found || r.Nickname != "Bob" {
+        t.Fatalf("Find: %v %v\n", r, err)
+    }
+    if err := m.Remove(&r); err == nil || err.Error() != "last Male user" {
+        t.Fatalf("Remove: %v\n", err)
+    }
+
+    // Hooks with pointer receivers run for an entity passed by value
+    if err := m.Remove(r); err == nil || err.Error() != "last Male user" {
+        t.Fatalf("Remove: by value: %v\n", err)
+    }
+}
+
+type article struct {
+    ArticleID    int64 `db:",pk,autoincr"`
+    Title        string
+    CreationTime time.Time `db:",created"`
+    UpdateTime   int64     `db:",updated"`
+}
+
+func (a *article) BeforeInsert(m *Model) error {
+    if a.Title == "" {
+        return fmt.Errorf("title is empty")
+    }
+    return nil
+}
+
+func (a *article) BeforeUpdate(m *Model) error {
+    return a.BeforeInsert(m)
+}
+
+func TestModelTimestamps(t *testing.T) {
+    s := NewServer("sqlite3", "sqlite3.db")
+    for _, v := range []string{`DROP TABLE IF EXISTS "article"`, `CREATE TABLE "article" ("ArticleID" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, "Title" TEXT NOT NULL, "CreationTime" DATETIME NOT NULL, "UpdateTime" INTEGER NOT NULL)`} {
+        if _, err := s.Exec(v); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+    Servers["passport"] = s
+    defer delete(Servers, "passport")
+
+    now := time.Date(2015, 1, 17, 8, 0, 0, 0, time.FixedZone("CST", 8*3600))
+    m := NewModel("passport", NewTable("article", article{}))
+    m.Table.Now = func() time.Time { return now }
+    m.Table.Location = time.UTC
+    if !reflect.DeepEqual(m.Table.UpdateFields, []string{"Title", "UpdateTime"}) {
+        t.Fatalf("UpdateFields: %#v\n", m.Table.UpdateFields)
+    }
+
+    a := article{Title: "Go"}
+    if err := m.Create(&a); err != nil {
+        t.Fatalf("Create: %v\n", err)
+    }
+    if !a.CreationTime.Equal(now) || a.CreationTime.Location() != time.UTC || a.UpdateTime != now.Unix() {
+        t.Fatalf("Create: %v\n", a)
+    }
+
+    // Update keeps the creation time
+    now = now.Add(time.Hour)
+    a.Title = "Go 1.4"
+    if err := m.Save(&a); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+    r := article{}
+    if err := m.Find(&r, a.ArticleID); err != nil {
+        t.Fatalf("Find: %v\n", err)
+    }
+    if !r.CreationTime.Equal(now.Add(-time.Hour)) || r.UpdateTime != now.Unix() {
+        t.Fatalf("Find: %v\n", r)
+    }
+
+    // Aborted insert and update leave the timestamps as they were
+    e := article{}
+    if err := m.Create(&e); err == nil || !e.CreationTime.IsZero() || e.UpdateTime != 0 {
+        t.Fatalf("Create: %v %v\n", e, err)
+    }
+    ut := r.UpdateTime
+    r.Title = ""
+    m.Table.Now = func() time.Time { return now.Add(time.Minute) }
+    if err := m.Save(&r); err == nil || r.UpdateTime != ut {
+        t.Fatalf("Save: %v %v\n", r, err)
+    }
+    m.Table.Now = func() time.Time { return now }
+
+    // Exec(Item) of a Model query
+    now = now.Add(time.Hour)
+    if _, err := m.Insert().Exec(Item{"Title": "SQL"}); err != nil {
+        t.Fatalf("Insert: %v\n", err)
+    }
+    if _, err := m.Update().Exec(Item{"Title": "SQL 2"}, Where{"Title": "SQL"}); err != nil {
+        t.Fatalf("Update: %v\n", err)
+    }
+    if err := m.Find(&r, a.ArticleID+1); err != nil || r.Title != "SQL 2" || !r.CreationTime.Equal(now) || r.UpdateTime != now.Unix() {
+        t.Fatalf("Find: %v %v\n", r, err)
+    }
+}
+
+type softUser struct {
+    UserID       int64 `db:",pk,autoincr"`
+    CreationTime string
+    BirthYear    int64
+    Gender       string
+    Nickname     string
+    UpdateTime   int64      `db:",updated"`
+    DeletionTime *time.Time `db:",softdelete"`
+}
+
+func TestModelSoftDelete(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    s := qt.Query.Server
+    for _, v := range []string{`ALTER TABLE "passport_user" ADD COLUMN "DeletionTime" DATETIME NULL`, `ALTER TABLE "passport_user" ADD COLUMN "UpdateTime" INTEGER NOT NULL DEFAULT 0`} {
+        if _, err := s.Exec(v); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+    Servers["passport"] = s
+    defer delete(Servers, "passport")
+
+    now := time.Date(2015, 1, 17, 8, 0, 0, 0, time.UTC)
+    m := NewModel("passport", NewTable("passport_user", softUser{}))
+    m.Table.Now = func() time.Time { return now }
+    users := []softUser{{Gender: "Male", Nickname: "Bob"}, {Gender: "Female", Nickname: "Alice"}, {Gender: "Male", Nickname: "Carol"}}
+    for i := range users {
+        users[i].CreationTime = "2015-01-17 00:00:00"
+        if err := m.Create(&users[i]); err != nil {
+            t.Fatalf("Create: %v\n", err)
+        }
+    }
+
+    // Delete is an update
+    if q := m.Delete(); q.Type != QueryUpdate || !strings.HasPrefix(strings.TrimSpace(q.ToString()), "UPDATE") {
+        t.Fatalf("Delete: %s\n", q.ToString())
+    }
+
+    // Remove sets the deletion time, the row is hidden
+    now = now.Add(time.Hour)
+    if err := m.Remove(&users[0]); err != nil {
+        t.Fatalf("Remove: %v\n", err)
+    }
+    r := softUser{}
+    if err := m.Find(&r, users[0].UserID); err != sql.ErrNoRows {
+        t.Fatalf("Find: %v\n", err)
+    }
+    q := m.Select()
+    d := []softUser{}
+    if err := q.Where(q.Eq("Gender", "Male"), q.OrEq("Gender", "Female")).Rows(&d); err != nil || len(d) != 2 {
+        t.Fatalf("Select: %v %v\n", d, err)
+    }
+    if n, err := m.WithTrashed().Count(); err != nil || n != 3 {
+        t.Fatalf("WithTrashed: %d %v\n", n, err)
+    }
+    d = []softUser{}
+    if err := m.OnlyTrashed().Rows(&d); err != nil || len(d) != 1 || d[0].DeletionTime == nil {
+        t.Fatalf("OnlyTrashed: %v %v\n", d, err)
+    }
+    if err := m.Unscoped().Find(&r, users[0].UserID); err != nil || r.Nickname != "Bob" || r.UpdateTime != now.Unix() {
+        t.Fatalf("Unscoped: %v %v\n", r, err)
+    }
+
+    // Restore, updated columns are set too
+    now = now.Add(time.Hour)
+    if err := m.Restore(&r); err != nil || r.DeletionTime != nil {
+        t.Fatalf("Restore: %v\n", err)
+    }
+    if n, err := m.Select().Count(); err != nil || n != 3 {
+        t.Fatalf("Restore: %d %v\n", n, err)
+    }
+    if err := m.Find(&r, users[0].UserID); err != nil || r.UpdateTime != now.Unix() {
+        t.Fatalf("Restore: %v %v\n", r, err)
+    }
+
+    // Delete with conditions
+    dq := m.Delete()
+    if re, err := dq.Where(dq.Eq("Nickname", "Bob")).Exec(); err != nil || re.RowsAffected != 1 {
+        t.Fatalf("Delete: %v %v\n", re, err)
+    }
+    if err := m.Restore(&r); err != nil {
+        t.Fatalf("Restore: %v\n", err)
+    }
+
+    // Unscoped deletes for real
+    if err := m.Unscoped().Remove(&users[1]); err != nil {
+        t.Fatalf("Remove: %v\n", err)
+    }
+    if n, err := m.WithTrashed().Count(); err != nil || n != 2 {
+        t.Fatalf("Unscoped: %d %v\n", n, err)
+    }
+
+    // Query.Unscoped drops the default condition
+    m.Remove(&users[2])
+    q = m.Select()
+    if n, err := q.Where(q.Eq("Gender", "Male")).Unscoped().Count(); err != nil || n != 2 {
+        t.Fatalf("Query.Unscoped: %d %v\n", n, err)
+    }
+}
+
+type document struct {
+    DocumentID int64 `db:",pk,autoincr"`
+    Title      string
+    Version    int `db:",version"`
+}
+
+func (d *document) BeforeInsert(m *Model) error {
+    if d.Title == "" {
+        return fmt.Errorf("title is empty")
+    }
+    return nil
+}
+
+func TestModelVersion(t *testing.T) {
+    s := NewServer("sqlite3", "sqlite3.db")
+    for _, v := range []string{`DROP TABLE IF EXISTS "document"`, `CREATE TABLE "document" ("DocumentID" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, "Title" TEXT NOT NULL, "Version" INTEGER NOT NULL)`} {
+        if _, err := s.Exec(v); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+    Servers["passport"] = s
+    defer delete(Servers, "passport")
+
+    m := NewModel("passport", NewTable("document", document{}))
+    if !reflect.DeepEqual(m.Table.UpdateFields, []string{"Title"}) {
+        t.Fatalf("UpdateFields: %#v\n", m.Table.UpdateFields)
+    }
+
+    // Aborted insert leaves the version as it was
+    e := document{}
+    if err := m.Create(&e); err == nil || e.Version != 0 {
+        t.Fatalf("Create: %v %v\n", e, err)
+    }
+
+    a := document{Title: "Go"}
+    if err := m.Create(&a); err != nil || a.Version != 1 {
+        t.Fatalf("Create: %v %v\n", a, err)
+    }
+    b := document{}
+    if err := m.Find(&b, a.DocumentID); err != nil || b.Version != 1 {
+        t.Fatalf("Find: %v %v\n", b, err)
+    }
+
+    // Save increments the version
+    a.Title = "Go 1.4"
+    if err := m.Save(&a); err != nil || a.Version != 2 {
+        t.Fatalf("Save: %v %v\n", a, err)
+    }
+
+    // b was read at version 1
+    b.Title = "Go 1.3"
+    err := m.Save(&b)
+    if !errors.Is(err, ErrStaleObject) {
+        t.Fatalf("Save: %v\n", err)
+    }
+    if e, ok := err.(*StaleObjectError); !ok || e.Version != 1 || e.Key["DocumentID"] != a.DocumentID || b.Version != 1 {
+        t.Fatalf("Save: %#v\n", err)
+    }
+    if err := m.Find(&b, a.DocumentID); err != nil || b.Title != "Go 1.4" || b.Version != 2 {
+        t.Fatalf("Find: %v %v\n", b, err)
+    }
+
+    // Nil UpdateFields or ones naming the version, it is incremented only
+    for _, fields := range [][]string{nil, {"Title", "Version"}} {
+        m.Table.UpdateFields = fields
+        b.Title = "Go 1.5"
+        v := b.Version
+        if err := m.Save(&b); err != nil || b.Version != v+1 {
+            t.Fatalf("Save: %v %v %v\n", fields, b, err)
+        }
+        if err := m.Find(&a, b.DocumentID); err != nil || a.Version != v+1 || a.Title != "Go 1.5" {
+            t.Fatalf("Find: %v %v %v\n", fields, a, err)
+        }
+    }
+}
+
+func TestModelTracked(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    s := qt.Query.Server
+    Servers["passport"] = s
+    defer delete(Servers, "passport")
+
+    m := NewModel("passport", NewTable("passport_user", modelUser{}))
+    if err := m.Snapshot(&modelUser{}); err == nil {
+        t.Fatalf("Snapshot: model is not tracked\n")
+    }
+    tm := m.Tracked()
+
+    u := modelUser{CreationTime: "2015-01-17 00:00:00", BirthYear: 1980, Gender: "Male", Nickname: "Bob"}
+    if err := tm.Create(&u); err != nil {
+        t.Fatalf("Create: %v\n", err)
+    }
+    if d, ok, err := tm.Changes(&u); err != nil || !ok || len(d) != 0 {
+        t.Fatalf("Changes: %v %v %v\n", d, ok, err)
+    }
+
+    // Another writer changes the gender
+    if _, err := s.Exec(`UPDATE "passport_user" SET "Gender" = 'Female' WHERE "UserID" = $1`, u.UserID); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+
+    // Nothing changed, nothing written
+    if err := tm.Save(&u); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+    r := modelUser{}
+    if err := m.Find(&r, u.UserID); err != nil || r.Gender != "Female" {
+        t.Fatalf("Save: %v %v\n", r, err)
+    }
+
+    // Only the nickname is written
+    u.Nickname = "Robert"
+    if d, ok, err := tm.Changes(&u); err != nil || !ok || !reflect.DeepEqual(d, Item{"Nickname": "Robert"}) {
+        t.Fatalf("Changes: %v %v %v\n", d, ok, err)
+    }
+    if err := tm.Save(&u); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+    if err := m.Find(&r, u.UserID); err != nil || r.Gender != "Female" || r.Nickname != "Robert" {
+        t.Fatalf("Save: %v %v\n", r, err)
+    }
+
+    // Row, Rows and Iter of a tracked model's query snapshot entities
+    w := modelUser{}
+    if err := tm.Select().Row(&w, Where{"UserID": u.UserID}); err != nil || w.Nickname != "Robert" {
+        t.Fatalf("Row: %v %v\n", w, err)
+    }
+    if d, ok, err := tm.Changes(&w); err != nil || !ok || len(d) != 0 {
+        t.Fatalf("Row: %v %v %v\n", d, ok, err)
+    }
+    rs := []modelUser{}
+    if err := tm.Select().Rows(&rs, Where{"UserID": u.UserID}); err != nil || len(rs) != 1 {
+        t.Fatalf("Rows: %v %v\n", rs, err)
+    }
+    rs[0].Gender = "Male"
+    if d, ok, err := tm.Changes(&rs[0]); err != nil || !ok || !reflect.DeepEqual(d, Item{"Gender": "Male"}) {
+        t.Fatalf("Rows: %v %v %v\n", d, ok, err)
+    }
+    var each *modelUser
+    eq := tm.Select()
+    err := eq.Where(eq.Eq("UserID", u.UserID)).Each(func(e *modelUser) error {
+        each = e
+        return nil
+    })
+    if _, ok, _ := tm.Changes(each); err != nil || !ok {
+        t.Fatalf("Each: %v %v\n", each, err)
+    }
+    if err := m.Select().Row(&r, Where{"UserID": u.UserID}); err != nil {
+        t.Fatalf("Row: %v\n", err)
+    }
+    if _, ok, _ := tm.Changes(&r); ok {
+        t.Fatalf("Row: untracked model took a snapshot\n")
+    }
+
+    // Find snapshots, Remove forgets
+    f := modelUser{}
+    if err := tm.Find(&f, u.UserID); err != nil {
+        t.Fatalf("Find: %v\n", err)
+    }
+    f.BirthYear = 1981
+    if d, ok, err := tm.Changes(&f); err != nil || !ok || !reflect.DeepEqual(d, Item{"BirthYear": int64(1981)}) {
+        t.Fatalf("Changes: %v %v %v\n", d, ok, err)
+    }
+    if err := tm.Remove(f); err != nil {
+        t.Fatalf("Remove: %v\n", err)
+    }
+    if _, ok, _ := tm.Changes(&f); ok {
+        t.Fatalf("Remove: snapshot is kept\n")
+    }
+
+    // Reset drops all snapshots
+    if err := tm.Snapshot(&u); err != nil {
+        t.Fatalf("Snapshot: %v\n", err)
+    }
+    tm.Reset()
+    if _, ok, _ := tm.Changes(&u); ok {
+        t.Fatalf("Reset: snapshot is kept\n")
+    }
+}
+
+func TestModelScopes(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    Servers["passport"] = qt.Query.Server
+    defer delete(Servers, "passport")
+
+    m := NewModel("passport", NewTable("passport_user", modelUser{}))
+    users := []modelUser{{BirthYear: 1980, Gender: "Male", Nickname: "Bob"}, {BirthYear: 1986, Gender: "Female", Nickname: "Alice"}, {BirthYear: 1990, Gender: "Male", Nickname: "Carol"}, {BirthYear: 1970, Gender: "Male", Nickname: "Hidden"}}
+    for i := range users {
+        users[i].CreationTime = "2015-01-17 00:00:00"
+        if err := m.Create(&users[i]); err != nil {
+            t.Fatalf("Create: %v\n", err)
+        }
+    }
+
+    m.AddScope("male", func(q *Query) *Query {
+        return q.Where(q.Eq("Gender", "Male"))
+    }).AddScope("recent", func(q *Query) *Query {
+        return q.Where(q.Gt("BirthYear", 1985))
+    }).AddDefaultScope(func(q *Query) *Query {
+        return q.Where(q.Ne("Nickname", "Hidden"))
+    })
+
+    // Scopes and Where are ANDed
+    if n, err := m.Select().Scope("male").Count(); err != nil || n != 2 {
+        t.Fatalf("Scope: %d %v\n", n, err)
+    }
+    d := []modelUser{}
+    if err := m.Select().Scope("male", "recent").Rows(&d); err != nil || len(d) != 1 || d[0].Nickname != "Carol" {
+        t.Fatalf("Scope: %v %v\n", d, err)
+    }
+    d = []modelUser{}
+    q := m.Select().Scope("male")
+    if err := q.Where(q.Lt("BirthYear", 1985)).Rows(&d); err != nil || len(d) != 1 || d[0].Nickname != "Bob" {
+        t.Fatalf("Scope: %v %v\n", d, err)
+    }
+    if err := m.Select().Scope("active").Rows(&d); err == nil {
+        t.Fatalf("Scope: unknown scope\n")
+    }
+
+    // Default scope applies to select, update and delete
+    r := modelUser{}
+    if err := m.Find(&r, users[3].UserID); err != sql.ErrNoRows {
+        t.Fatalf("Find: %v\n", err)
+    }
+    if err := m.Unscoped().Find(&r, users[3].UserID); err != nil || r.Nickname != "Hidden" {
+        t.Fatalf("Unscoped: %v %v\n", r, err)
+    }
+
+    // Save does not update a hidden row
+    h := users[3]
+    h.BirthYear = 1971
+    if err := m.Save(&h); err == nil {
+        t.Fatalf("Save: hidden row\n")
+    }
+    tm := m.Tracked()
+    if err := tm.Snapshot(&h); err != nil {
+        t.Fatalf("Snapshot: %v\n", err)
+    }
+    h.BirthYear = 1972
+    if err := tm.Save(&h); err != sql.ErrNoRows || h.BirthYear != 1972 {
+        t.Fatalf("Save: %v\n", err)
+    }
+    if err := m.Unscoped().Find(&r, users[3].UserID); err != nil || r.BirthYear != 1970 {
+        t.Fatalf("Save: %v %v\n", r, err)
+    }
+    if err := m.Unscoped().Save(&h); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+    if err := m.Unscoped().Find(&r, users[3].UserID); err != nil || r.BirthYear != 1972 {
+        t.Fatalf("Save: %v %v\n", r, err)
+    }
+
+    // Saving unchanged values is no error
+    if err := m.Save(&users[0]); err != nil {
+        t.Fatalf("Save: %v\n", err)
+    }
+
+    if re, err := m.Update().Exec(Item{"BirthYear": 2000}, Where{"Gender": "Male"}); err != nil || re.RowsAffected != 2 {
+        t.Fatalf("Update: %v %v\n", re, err)
+    }
+    if re, err := m.Delete().Exec(Where{"Gender": "Male"}); err != nil || re.RowsAffected != 2 {
+        t.Fatalf("Delete: %v %v\n", re, err)
+    }
+    if n, err := m.Unscoped().Select().Count(); err != nil || n != 2 {
+        t.Fatalf("Unscoped: %d %v\n", n, err)
+    }
+}
@@ -0,0 +1,228 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package outbox implements the transactional outbox pattern on db.Server.
+//
+// Events are inserted into the outbox table with Add, in the same transaction
+// as the business writes, so they exist if and only if the transaction
+// commits. A Relay polls the table, hands undelivered events to a callback in
+// insertion order and marks them delivered. Delivery is at least once: the
+// callback may see an event again if the relay dies before marking it, so
+// consumers should deduplicate by Event.EventID.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zhgo/db"
+)
+
+// Event
+type Event struct {
+	// Primary key, increasing in insertion order
+	EventID int64
+
+	// Topic or event type
+	Topic string
+
+	// Event data
+	Payload string
+
+	// Time the event was added
+	CreationTime time.Time
+}
+
+// Row of outbox table, times are unix milliseconds
+type eventRow struct {
+	EventID      int64
+	Topic        string
+	Payload      string
+	CreationTime int64
+}
+
+// Outbox
+type Outbox struct {
+	// Server
+	Server *db.Server
+
+	// Outbox table name
+	Table string
+
+	// Clock
+	Now func() time.Time
+}
+
+// Outbox table DDL
+var schemas = map[string][]string{
+	"mysql": []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+  "EventID" bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  "Topic" varchar(128) NOT NULL,
+  "Payload" longtext NOT NULL,
+  "CreationTime" bigint(20) NOT NULL,
+  "DeliveredTime" bigint(20) NOT NULL DEFAULT 0,
+  PRIMARY KEY ("EventID"),
+  KEY "Pending" ("DeliveredTime", "EventID")
+) ENGINE=InnoDB DEFAULT CHARSET=utf8`},
+	"postgres": []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+    "EventID" BIGSERIAL PRIMARY KEY,
+    "Topic" varchar(128) NOT NULL,
+    "Payload" text NOT NULL,
+    "CreationTime" bigint NOT NULL,
+    "DeliveredTime" bigint NOT NULL DEFAULT 0
+)`,
+		`CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s ("DeliveredTime", "EventID")`},
+	"sqlite3": []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+  "EventID" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+  "Topic" TEXT NOT NULL,
+  "Payload" TEXT NOT NULL,
+  "CreationTime" INTEGER NOT NULL,
+  "DeliveredTime" INTEGER NOT NULL DEFAULT 0
+)`,
+		`CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s ("DeliveredTime", "EventID")`}}
+
+// Create outbox table if not exists
+func (o *Outbox) CreateTable() error {
+	stmts, ok := schemas[o.Server.Type]
+	if !ok {
+		return fmt.Errorf("outbox: unsupported database type %q", o.Server.Type)
+	}
+
+	for _, v := range stmts {
+		str := fmt.Sprintf(v, db.QuoteIdentifier(o.Table), db.QuoteIdentifier(o.Table+"_Pending"))
+		if _, err := o.Server.Exec(str); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add an event in tx, it is published only if tx commits.
+func (o *Outbox) Add(tx *db.Tx, topic string, payload string) (int64, error) {
+	q := tx.InsertInto(o.Table)
+	q.SetPrimary("EventID") // PostgreSQL compatibility
+	q.Fields("Topic", "Payload", "CreationTime", "DeliveredTime")
+	r, err := q.Values(topic, payload, millis(o.Now()), 0).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return r.LastInsertId, nil
+}
+
+// Delete events delivered before t
+func (o *Outbox) Purge(t time.Time) (int64, error) {
+	q := o.Server.DeleteFrom(o.Table)
+	r, err := q.Where(q.Gt("DeliveredTime", 0), q.AndLt("DeliveredTime", millis(t))).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected, nil
+}
+
+// New relay delivering events to handler
+func (o *Outbox) NewRelay(handler func(e *Event) error) *Relay {
+	return &Relay{Outbox: o, Handler: handler, BatchSize: 100, Interval: time.Second}
+}
+
+// Relay polls the outbox and delivers events
+type Relay struct {
+	// Outbox
+	Outbox *Outbox
+
+	// Callback, an error stops the batch and the event is delivered again on the next poll.
+	Handler func(e *Event) error
+
+	// Events per poll
+	BatchSize int64
+
+	// Wait between polls when the outbox is drained
+	Interval time.Duration
+}
+
+// Deliver one batch of pending events, return the number delivered.
+//
+// On MySQL and PostgreSQL the batch is locked with FOR UPDATE SKIP LOCKED, so
+// several relays can run at once. sqlite3 has no row locks, run one relay only.
+func (r *Relay) RunOnce() (int, error) {
+	o := r.Outbox
+	n := 0
+	var handlerErr error
+
+	err := o.Server.Transaction(func(tx *db.Tx) error {
+		d := []eventRow{}
+		q := tx.Select("EventID", "Topic", "Payload", "CreationTime").From(o.Table)
+		q.Where(q.Eq("DeliveredTime", 0)).OrderAsc("EventID").Limit(0, r.BatchSize)
+		if o.Server.Type != "sqlite3" {
+			q.ForUpdate().SkipLocked()
+		}
+		if err := q.Rows(&d); err != nil {
+			return err
+		}
+
+		for _, v := range d {
+			e := &Event{
+				EventID:      v.EventID,
+				Topic:        v.Topic,
+				Payload:      v.Payload,
+				CreationTime: time.Unix(0, v.CreationTime*int64(time.Millisecond)),
+			}
+			if handlerErr = r.Handler(e); handlerErr != nil {
+				return nil
+			}
+
+			// Idempotent, an event already marked is left as is.
+			u := tx.Update(o.Table).Set("DeliveredTime", millis(o.Now()))
+			if _, err := u.Where(u.Eq("EventID", v.EventID), u.AndEq("DeliveredTime", 0)).Exec(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, handlerErr
+}
+
+// Poll until ctx is done. Errors are logged and retried after Interval.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RunOnce()
+		if err != nil {
+			log.Printf("outbox: %s\n", err)
+		}
+
+		// A full batch means more events are probably waiting.
+		if err == nil && int64(n) == r.BatchSize {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.Interval):
+		}
+	}
+}
+
+// New Outbox, using table "outbox_event"
+func New(server *db.Server) *Outbox {
+	return &Outbox{Server: server, Table: "outbox_event", Now: time.Now}
+}
+
+// Unix milliseconds
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhgo/db"
+)
+
+func TestOutbox(t *testing.T) {
+	s := db.NewServer("sqlite3", "sqlite3.db")
+	if _, err := s.Exec(`DROP TABLE IF EXISTS "outbox_event"`); err != nil {
+		t.Fatalf("[%s]: %v\n", s.Type, err)
+	}
+
+	o := New(s)
+	if err := o.CreateTable(); err != nil {
+		t.Fatalf("[%s]: %v\n", s.Type, err)
+	}
+
+	// Committed events are published, rolled back ones are not
+	for _, v := range []string{"a", "b", "c"} {
+		err := s.Transaction(func(tx *db.Tx) error {
+			_, err := o.Add(tx, "user.created", v)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Add: %v\n", err)
+		}
+	}
+	s.Transaction(func(tx *db.Tx) error {
+		o.Add(tx, "user.created", "rolled back")
+		return errors.New("abort")
+	})
+
+	// Handler error stops the batch, the event is delivered again
+	delivered := []string{}
+	fail := "b"
+	relay := o.NewRelay(func(e *Event) error {
+		if e.Payload == fail {
+			return errors.New("broker down")
+		}
+		delivered = append(delivered, e.Payload)
+		return nil
+	})
+
+	n, err := relay.RunOnce()
+	if n != 1 || err == nil || err.Error() != "broker down" {
+		t.Fatalf("RunOnce: %d %v\n", n, err)
+	}
+
+	fail = ""
+	n, err = relay.RunOnce()
+	if n != 2 || err != nil {
+		t.Fatalf("RunOnce: %d %v\n", n, err)
+	}
+	if len(delivered) != 3 || delivered[0] != "a" || delivered[1] != "b" || delivered[2] != "c" {
+		t.Fatalf("delivered: %v\n", delivered)
+	}
+
+	// Nothing left, Run stops with ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	relay.Interval = 10 * time.Millisecond
+	if err := relay.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Run: %v\n", err)
+	}
+	if len(delivered) != 3 {
+		t.Fatalf("delivered: %v\n", delivered)
+	}
+
+	// Purge delivered events
+	n64, err := o.Purge(time.Now().Add(time.Minute))
+	if n64 != 3 || err != nil {
+		t.Fatalf("Purge: %d %v\n", n64, err)
+	}
+}
@@ -5,10 +5,13 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 // Query type
@@ -26,6 +29,9 @@ var queryNodes = map[uint][]string{
 	QueryDelete: []string{"Delete", "Where"},
 	QuerySelect: []string{"Select", "From", "Join", "Where", "Group", "Having", "Order", "Limit", "ForUpdate"}}
 
+// Row locking is not supported by the database, sqlite3 locks the whole database in a write transaction.
+var ErrLockNotSupported = errors.New("row locking is not supported by sqlite3")
+
 // Query struct
 type Query struct {
 	// Server
@@ -34,9 +40,12 @@ type Query struct {
 	// Query type: Insert, Update, Delete, Select
 	Type uint
 
-	// Table primary field
+	// Table primary field, the first one of a composite key
 	Primary string
 
+	// Table primary fields, composite key
+	Primaries []string
+
 	// Sql
 	Sql map[string]string
 
@@ -52,8 +61,79 @@ type Query struct {
 	// If the query object is created by Model, this is will be assigned. optional.
 	Table *Table
 
+	// If the query object is created by Tx, it runs in this transaction. optional.
+	Tx *Tx
+
+	// Context of Exec, Row, Rows and Iter. optional.
+	ctx context.Context
+
 	// Current Sql node
 	current string
+
+	// First error found while building the query, returned by Exec, Row and Rows.
+	err error
+
+	// Order by terms
+	orders []orderTerm
+
+	// Index of the first term added by the last Order call
+	lastOrder int
+
+	// Row lock: UPDATE or SHARE
+	lock string
+
+	// Row lock wait policy: NOWAIT or SKIP LOCKED
+	lockWait string
+
+	// Conditions of Where and Exec(where), without WHERE
+	where string
+
+	// Default conditions ANDed with where, like soft delete. Dropped by Unscoped.
+	defaults []defaultCond
+
+	// Relations of Table loaded by Row and Rows
+	preloads []string
+
+	// Named scopes, of the Model that created the query
+	scopes map[string]Scope
+
+	// Conditions added by scopes, ANDed with where
+	scoped []string
+
+	// Snapshots of the tracked Model that created the query, entities
+	// scanned by Row, Rows and Iter are added
+	snapshots *snapshots
+}
+
+// Query scope, adds conditions, order, limit... to q. Conditions of Where
+// called in a scope are ANDed with those of the query and other scopes.
+type Scope func(q *Query) *Query
+
+// Default condition, rendered when the query is built
+type defaultCond struct {
+	// Expression, ? are replaced with placeholders of args
+	expr string
+
+	// Args of expr
+	args []interface{}
+
+	// Rendered SQL, with placeholders
+	sql string
+}
+
+// Order by term
+type orderTerm struct {
+	// Quoted field or raw expression
+	expr string
+
+	// Is expr a raw expression
+	raw bool
+
+	// ASC or DESC
+	sort string
+
+	// "", FIRST or LAST
+	nulls string
 }
 
 // A Result summarizes an executed SQL command.
@@ -69,6 +149,10 @@ type Result struct {
 	// update, insert, or delete. Not every database or database
 	// driver may support this.
 	RowsAffected int64
+
+	// Primary key of the inserted row: returned by PostgreSQL, otherwise
+	// taken from the inserted values and LastInsertId.
+	Keys Item
 }
 
 // Condition struct
@@ -257,20 +341,62 @@ func (q *Query) quoteFields(f []string) []string {
 	return nf
 }
 
-// Quote filed
+// "expr AS alias"
+var aliasRegexp = regexp.MustCompile(`(?i)^(.+?)\s+AS\s+(.+)$`)
+
+// Quote filed, support "table.field", "table.*" and "field AS alias"
 func (q *Query) quoteField(f string) string {
 	fs := strings.Trim(f, " \r\n\t")
 	if fs == "*" || fs == "1" {
-		return f
+		return fs
+	}
+
+	if m := aliasRegexp.FindStringSubmatch(fs); m != nil {
+		return fmt.Sprintf("%s AS %s", q.quoteField(m[1]), q.quoteIdentifier(strings.TrimSpace(m[2])))
 	}
 
 	if q.Table != nil {
 		if fm, ok := q.Table.FiledsMap[fs]; ok {
-			f = fm
+			fs = fm
+		}
+	}
+
+	ps := strings.Split(fs, ".")
+	for i, p := range ps {
+		if p == "*" && i > 0 && i == len(ps)-1 {
+			continue
 		}
+		ps[i] = q.quoteIdentifier(p)
+	}
+	return strings.Join(ps, ".")
+}
+
+// Quote a single identifier, remember the first invalid one
+func (q *Query) quoteIdentifier(s string) string {
+	if err := CheckIdentifier(s); err != nil && q.err == nil {
+		q.err = err
 	}
+	return QuoteIdentifier(s)
+}
 
-	return fmt.Sprintf("\"%s\"", strings.Replace(f, ".", "\".\"", -1))
+// Check identifier, reject what can not be quoted safely in any dialect
+func CheckIdentifier(s string) error {
+	if s == "" {
+		return errors.New("empty identifier")
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		return fmt.Errorf("identifier contains NUL byte: %q", s)
+	}
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("identifier is not valid UTF-8: %q", s)
+	}
+	return nil
+}
+
+// Quote identifier in standard SQL, embedded " is doubled.
+// For MySQL the Server converts it to `...` with embedded ` doubled.
+func QuoteIdentifier(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
 }
 
 // Placeholder
@@ -280,6 +406,29 @@ func (q *Query) placeholder(v interface{}) string {
 	return fmt.Sprintf("$%d", q.ArgIndex)
 }
 
+// Raw SQL expression, replace ? with placeholders of args.
+// Without args, expr is used as is.
+func (q *Query) expr(expr string, args []interface{}) string {
+	if len(args) == 0 {
+		return expr
+	}
+
+	if strings.Count(expr, "?") != len(args) {
+		if q.err == nil {
+			q.err = fmt.Errorf("expression %q needs %d args, got %d", expr, strings.Count(expr, "?"), len(args))
+		}
+		return expr
+	}
+
+	str := ""
+	for _, v := range args {
+		i := strings.Index(expr, "?")
+		str += expr[:i] + q.placeholder(v)
+		expr = expr[i+1:]
+	}
+	return str + expr
+}
+
 // Insert
 func (q *Query) InsertInto(tb string) *Query {
 	q.Type = QueryInsert
@@ -288,9 +437,21 @@ func (q *Query) InsertInto(tb string) *Query {
 	return q
 }
 
-// Set primary field
-func (q *Query) SetPrimary(p string) {
-	q.Primary = p
+// Set primary field, or fields of a composite key
+func (q *Query) SetPrimary(p ...string) {
+	q.Primary = ""
+	if len(p) > 0 {
+		q.Primary = p[0]
+	}
+	q.Primaries = p
+}
+
+// Primary fields
+func (q *Query) primaries() []string {
+	if len(q.Primaries) == 0 && q.Primary != "" {
+		return []string{q.Primary}
+	}
+	return q.Primaries
 }
 
 // Fields(Insert)
@@ -350,9 +511,8 @@ func (q *Query) DeleteFrom(tb string) *Query {
 func (q *Query) Select(f ...string) *Query {
 	q.Type = QuerySelect
 	if len(f) == 0 {
-		// Warring!
-		// If use struct type as return data type, must keep have same sequence
-		// about struct fileds and table fileds.
+		// Struct fields are matched to columns by name, columns without a
+		// matching field are an error unless Server.IgnoreUnknownColumns is set.
 		q.Sql["Select"] = " SELECT *"
 	} else {
 		q.Sql["Select"] = fmt.Sprintf(" SELECT %s ", q.joinFields(f))
@@ -410,12 +570,87 @@ func (q *Query) On(qs ...string) *Query {
 
 // Where
 func (q *Query) Where(qs ...string) *Query {
-	q.Sql["Where"] = fmt.Sprintf(" WHERE %s ", strings.Join(qs, " "))
+	q.where = strings.Join(qs, " ")
+	q.Sql["Where"] = fmt.Sprintf(" WHERE %s ", q.where)
 	q.SqlCond = make([]string, 0)
 	q.current = "Where"
 	return q
 }
 
+// Add a default condition, ANDed with Where until Unscoped is called.
+// ? in expr are replaced with placeholders of args.
+func (q *Query) DefaultWhere(expr string, args ...interface{}) *Query {
+	q.defaults = append(q.defaults, defaultCond{expr: expr, args: args})
+	return q
+}
+
+// Drop default conditions, like the soft delete condition of Model.Select
+func (q *Query) Unscoped() *Query {
+	q.defaults = nil
+	if q.where == "" {
+		delete(q.Sql, "Where")
+	} else {
+		q.Sql["Where"] = fmt.Sprintf(" WHERE %s ", q.where)
+	}
+	return q
+}
+
+// Apply named scopes of the Model, an unknown name is an error of the query
+func (q *Query) Scope(names ...string) *Query {
+	for _, n := range names {
+		s, ok := q.scopes[n]
+		if !ok {
+			if q.err == nil {
+				q.err = fmt.Errorf("scope %s not found", n)
+			}
+			continue
+		}
+		q.applyScope(s)
+	}
+	return q
+}
+
+// Run s, keep conditions it sets by Where apart from those of the query
+func (q *Query) applyScope(s Scope) {
+	where, node, cond := q.where, q.Sql["Where"], q.SqlCond
+	q.where = ""
+	s(q)
+	if q.where != "" {
+		q.scoped = append(q.scoped, q.where)
+	}
+
+	q.where, q.SqlCond = where, cond
+	if node == "" {
+		delete(q.Sql, "Where")
+	} else {
+		q.Sql["Where"] = node
+	}
+}
+
+// Render default conditions, conditions of scopes and where. Placeholders
+// of default conditions are taken once, after those of the query.
+func (q *Query) renderWhere() {
+	if len(q.defaults) == 0 && len(q.scoped) == 0 {
+		return
+	}
+
+	cs := make([]string, 0, len(q.defaults)+len(q.scoped)+1)
+	for i, d := range q.defaults {
+		if d.sql == "" {
+			d.sql = q.expr(d.expr, d.args)
+			q.defaults[i] = d
+		}
+		cs = append(cs, fmt.Sprintf("(%s)", d.sql))
+	}
+	for _, w := range q.scoped {
+		cs = append(cs, fmt.Sprintf("(%s)", w))
+	}
+	if q.where != "" {
+		cs = append(cs, fmt.Sprintf("(%s)", q.where))
+	}
+	q.Sql["Where"] = fmt.Sprintf(" WHERE %s ", strings.Join(cs, " AND "))
+}
+
 // Group By
 func (q *Query) GroupBy(f ...string) *Query {
 	q.Sql["Group"] = fmt.Sprintf(" GROUP BY %s ", q.joinFields(f))
@@ -432,28 +667,181 @@ func (q *Query) Having(qs ...string) *Query {
 
 // order by
 func (q *Query) orderBy(sort string, f ...string) *Query {
-	q.Sql["Order"] = fmt.Sprintf(" ORDER BY %s %s ", q.joinFields(f), sort)
-	q.current = "Order"
-	return q
+	q.lastOrder = len(q.orders)
+	for _, v := range f {
+		q.orders = append(q.orders, orderTerm{expr: q.quoteField(v), sort: sort})
+	}
+	return q.renderOrder()
+}
+
+// order by expression
+func (q *Query) orderByExpr(sort string, expr string, args []interface{}) *Query {
+	q.lastOrder = len(q.orders)
+	q.orders = append(q.orders, orderTerm{expr: q.expr(expr, args), raw: true, sort: sort})
+	return q.renderOrder()
 }
 
-// Order ASC
+// Order ASC, can be called multiple times to add more fields
 func (q *Query) OrderAsc(f ...string) *Query {
 	return q.orderBy("ASC", f...)
 }
 
-// Order DESC
+// Order DESC, can be called multiple times to add more fields
 func (q *Query) OrderDesc(f ...string) *Query {
 	return q.orderBy("DESC", f...)
 }
 
-// Limit
+// Order by terms like "a DESC", "b", "c ASC NULLS LAST"
+func (q *Query) OrderBy(terms ...string) *Query {
+	first := len(q.orders)
+	for _, term := range terms {
+		ws := strings.Fields(term)
+		nulls := ""
+		if n := len(ws); n > 2 && strings.EqualFold(ws[n-2], "NULLS") {
+			nulls = strings.ToUpper(ws[n-1])
+			if nulls != "FIRST" && nulls != "LAST" && q.err == nil {
+				q.err = fmt.Errorf("invalid order by term: %q", term)
+			}
+			ws = ws[:n-2]
+		}
+
+		sort := "ASC"
+		if n := len(ws); n > 1 && (strings.EqualFold(ws[n-1], "ASC") || strings.EqualFold(ws[n-1], "DESC")) {
+			sort = strings.ToUpper(ws[n-1])
+			ws = ws[:n-1]
+		}
+
+		q.orderBy(sort, strings.Join(ws, " "))
+		q.orders[len(q.orders)-1].nulls = nulls
+	}
+	q.lastOrder = first
+	return q.renderOrder()
+}
+
+// Order ASC by expression, ? in expr are replaced with placeholders of args
+func (q *Query) OrderAscExpr(expr string, args ...interface{}) *Query {
+	return q.orderByExpr("ASC", expr, args)
+}
+
+// Order DESC by expression, ? in expr are replaced with placeholders of args
+func (q *Query) OrderDescExpr(expr string, args ...interface{}) *Query {
+	return q.orderByExpr("DESC", expr, args)
+}
+
+// NULLS FIRST, for the terms of the last Order call
+func (q *Query) NullsFirst() *Query {
+	return q.nulls("FIRST")
+}
+
+// NULLS LAST, for the terms of the last Order call
+func (q *Query) NullsLast() *Query {
+	return q.nulls("LAST")
+}
+
+// nulls
+func (q *Query) nulls(n string) *Query {
+	for i := q.lastOrder; i < len(q.orders); i++ {
+		q.orders[i].nulls = n
+	}
+	return q.renderOrder()
+}
+
+// Render order by terms to Sql["Order"].
+// MySQL has no NULLS FIRST/LAST, emulate it by sorting on "expr IS NULL" first.
+func (q *Query) renderOrder() *Query {
+	ts := make([]string, 0, len(q.orders))
+	for _, o := range q.orders {
+		if o.nulls == "" {
+			ts = append(ts, fmt.Sprintf("%s %s", o.expr, o.sort))
+			continue
+		}
+
+		if q.Server != nil && q.Server.Type == "mysql" {
+			e := o.expr
+			if o.raw {
+				e = fmt.Sprintf("(%s)", e)
+			}
+			if o.nulls == "FIRST" {
+				ts = append(ts, fmt.Sprintf("%s IS NOT NULL", e))
+			} else {
+				ts = append(ts, fmt.Sprintf("%s IS NULL", e))
+			}
+			ts = append(ts, fmt.Sprintf("%s %s", o.expr, o.sort))
+			continue
+		}
+
+		ts = append(ts, fmt.Sprintf("%s %s NULLS %s", o.expr, o.sort, o.nulls))
+	}
+
+	q.Sql["Order"] = fmt.Sprintf(" ORDER BY %s ", strings.Join(ts, ", "))
+	q.current = "Order"
+	return q
+}
+
+// Limit, "LIMIT rows OFFSET offset" is understood by all supported databases
 func (q *Query) Limit(offset, rows int64) *Query {
-	q.Sql["Limit"] = fmt.Sprintf(" LIMIT %d, %d ", offset, rows)
+	if offset == 0 {
+		q.Sql["Limit"] = fmt.Sprintf(" LIMIT %d ", rows)
+	} else {
+		q.Sql["Limit"] = fmt.Sprintf(" LIMIT %d OFFSET %d ", rows, offset)
+	}
 	q.current = "Limit"
 	return q
 }
 
+// FOR UPDATE, lock selected rows until the end of the transaction
+func (q *Query) ForUpdate() *Query {
+	q.lock = "UPDATE"
+	return q.renderLock()
+}
+
+// FOR SHARE, lock selected rows against concurrent updates until the end of the transaction.
+// MySQL gets LOCK IN SHARE MODE, understood before 8.0, unless NOWAIT or SKIP LOCKED
+// is set: these need MySQL 8.0.
+func (q *Query) ForShare() *Query {
+	q.lock = "SHARE"
+	return q.renderLock()
+}
+
+// NOWAIT, fail instead of waiting for locked rows. Implies FOR UPDATE if no lock is set.
+func (q *Query) NoWait() *Query {
+	q.lockWait = "NOWAIT"
+	return q.renderLock()
+}
+
+// SKIP LOCKED, skip rows locked by others. Implies FOR UPDATE if no lock is set.
+func (q *Query) SkipLocked() *Query {
+	q.lockWait = "SKIP LOCKED"
+	return q.renderLock()
+}
+
+// Render row lock to Sql["ForUpdate"]
+func (q *Query) renderLock() *Query {
+	if q.Server != nil && q.Server.Type == "sqlite3" {
+		if q.err == nil {
+			q.err = ErrLockNotSupported
+		}
+		return q
+	}
+
+	if q.lock == "" {
+		q.lock = "UPDATE"
+	}
+
+	if q.lock == "SHARE" && q.lockWait == "" && q.Server != nil && q.Server.Type == "mysql" {
+		q.Sql["ForUpdate"] = " LOCK IN SHARE MODE "
+		q.current = "ForUpdate"
+		return q
+	}
+
+	q.Sql["ForUpdate"] = fmt.Sprintf(" FOR %s ", q.lock)
+	if q.lockWait != "" {
+		q.Sql["ForUpdate"] += fmt.Sprintf("%s ", q.lockWait)
+	}
+	q.current = "ForUpdate"
+	return q
+}
+
 // Parse
 func (q *Query) Parse(c Condition) *Query {
 	conds := []string{q.Eq("1", "1")}
@@ -495,12 +883,7 @@ func (q *Query) Parse(c Condition) *Query {
 
 // Connect all sql part to a corect sql string.
 func (q *Query) ToString() string {
-	str := ""
-	nodes := queryNodes[q.Type]
-
-	for _, node := range nodes {
-		str += q.Sql[node]
-	}
+	str := q.build()
 
 	if Env < 2 {
 		log.Printf("%s\n", str)
@@ -512,6 +895,17 @@ func (q *Query) ToString() string {
 	return str
 }
 
+// Connect all sql part, without logging
+func (q *Query) build() string {
+	q.renderWhere()
+
+	str := ""
+	for _, node := range queryNodes[q.Type] {
+		str += q.Sql[node]
+	}
+	return str
+}
+
 // Parse map data to insert SQL
 func (q *Query) mapToInsert(d Item) {
 	f := make([]string, 0)
@@ -539,35 +933,64 @@ func (q *Query) mapToUpdate(d Item) {
 
 // Parse map data to where SQL
 func (q *Query) mapToWhere(d Where) {
-	i := 0
+	cs := make([]string, 0, len(d))
 	for k, v := range d {
-		if i == 0 {
-			q.Sql["Where"] = fmt.Sprintf(" WHERE %s = %s ", q.quoteField(k), q.placeholder(v))
-		} else {
-			q.Sql["Where"] += fmt.Sprintf(" AND %s = %s ", q.quoteField(k), q.placeholder(v))
-		}
-		i++
+		cs = append(cs, fmt.Sprintf("%s = %s", q.quoteField(k), q.placeholder(v)))
+	}
+	if len(cs) > 0 {
+		q.Where(strings.Join(cs, " AND "))
 	}
 }
 
-// Exec
-func (q *Query) Exec(d ...map[string]interface{}) (Result, error) {
+// Exec, d are maps or structs: values to insert, values to update and where.
+// A Where alone is the where of an update whose values are Set.
+func (q *Query) Exec(d ...interface{}) (Result, error) {
 	re := Result{}
 	if q.Server == nil {
 		return re, errors.New("DB config not found")
 	}
+	if q.err != nil {
+		return re, q.err
+	}
+
+	// Update of Set values, d is only the where
+	if q.Type == QueryUpdate && len(d) == 1 {
+		if w, ok := d[0].(Where); ok {
+			q.mapToWhere(w)
+			d = nil
+		}
+	}
+
+	items := make([]Item, len(d))
+	for i, v := range d {
+		item, err := toItem(v)
+		if err != nil {
+			return re, err
+		}
+		items[i] = item
+	}
+
+	// Created and updated columns of a Model query
+	if q.Table != nil && len(items) >= 1 && (q.Type == QueryInsert || q.Type == QueryUpdate) {
+		d := make(Item, len(items[0]))
+		for k, v := range items[0] {
+			d[k] = v
+		}
+		q.Table.touchItem(d, q.Type == QueryInsert)
+		items[0] = d
+	}
 
 	switch q.Type {
 	case QueryInsert:
-		if len(d) == 1 {
-			q.mapToInsert(d[0])
+		if len(items) == 1 {
+			q.mapToInsert(items[0])
 		}
 
 		// https://github.com/lib/pq/issues/24
 		if q.Server.Type == "postgres" {
-			q.Sql["Returning"] = fmt.Sprintf("RETURNING %s", q.quoteField(q.Primary))
+			q.Sql["Returning"] = fmt.Sprintf("RETURNING %s", q.joinFields(q.primaries()))
 			row := make(Item)
-			err := q.Server.Row(&row, q.ToString(), q.Args...)
+			err := q.executor().RowContext(q.context(), &row, q.ToString(), q.Args...)
 			if err != nil {
 				return re, err
 			}
@@ -575,25 +998,28 @@ func (q *Query) Exec(d ...map[string]interface{}) (Result, error) {
 			if !ok {
 				return re, errors.New(fmt.Sprintf("no LastInsertId available: %#v", row))
 			}
-			re.LastInsertId = lastInsertId.(int64)
+			if id, ok := lastInsertId.(int64); ok {
+				re.LastInsertId = id
+			}
+			re.Keys = row
 			return re, nil
 		}
 
 	case QueryUpdate:
-		if len(d) >= 1 {
-			q.mapToUpdate(d[0])
+		if len(items) >= 1 {
+			q.mapToUpdate(items[0])
 		}
-		if len(d) == 2 {
-			q.mapToWhere(d[1])
+		if len(items) == 2 {
+			q.mapToWhere(Where(items[1]))
 		}
 
 	case QueryDelete:
-		if len(d) == 1 {
-			q.mapToWhere(d[0])
+		if len(items) == 1 {
+			q.mapToWhere(Where(items[0]))
 		}
 	}
 
-	r, err := q.Server.Exec(q.ToString(), q.Args...)
+	r, err := q.executor().ExecContext(q.context(), q.ToString(), q.Args...)
 	if err != nil {
 		return re, err
 	}
@@ -607,6 +1033,21 @@ func (q *Query) Exec(d ...map[string]interface{}) (Result, error) {
 		return re, err
 	}
 	re.RowsAffected = rowsAffected
+
+	if q.Type == QueryInsert && len(q.primaries()) > 0 {
+		re.Keys = make(Item)
+		for _, p := range q.primaries() {
+			if len(items) == 1 {
+				if v, ok := items[0][p]; ok {
+					re.Keys[p] = v
+					continue
+				}
+			}
+			if p == q.Primary && lastInsertId != 0 {
+				re.Keys[p] = lastInsertId
+			}
+		}
+	}
 	return re, nil
 }
 
@@ -615,10 +1056,33 @@ func (q *Query) Row(ptr interface{}, d ...Where) error {
 	if q.Server == nil {
 		return errors.New("DB config not found")
 	}
+	if q.err != nil {
+		return q.err
+	}
 	if len(d) == 1 {
 		q.mapToWhere(d[0])
 	}
-	return q.Server.Row(ptr, q.ToString(), q.Args...)
+	if len(q.preloads) == 0 && q.snapshots == nil {
+		return q.executor().RowContext(q.context(), ptr, q.ToString(), q.Args...)
+	}
+
+	// Relations are loaded and snapshots taken only if a row is found
+	it, err := q.executor().IterContext(q.context(), q.ToString(), q.Args...)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	if !it.Next() {
+		return it.Err()
+	}
+	if err := it.Scan(ptr); err != nil {
+		return err
+	}
+	it.Close()
+	if err := q.track(ptr); err != nil || len(q.preloads) == 0 {
+		return err
+	}
+	return q.preload(ptr)
 }
 
 // Rows
@@ -626,10 +1090,131 @@ func (q *Query) Rows(ptr interface{}, d ...Where) error {
 	if q.Server == nil {
 		return errors.New("DB config not found")
 	}
+	if q.err != nil {
+		return q.err
+	}
 	if len(d) == 1 {
 		q.mapToWhere(d[0])
 	}
-	return q.Server.Rows(ptr, q.ToString(), q.Args...)
+	if err := q.executor().RowsContext(q.context(), ptr, q.ToString(), q.Args...); err != nil {
+		return err
+	}
+	if err := q.track(ptr); err != nil || len(q.preloads) == 0 {
+		return err
+	}
+	return q.preload(ptr)
+}
+
+// Load relations of Table into the entities scanned by Row and Rows, with one
+// query per relation. Nested relations are separated by dots, like "Roles.Permissions".
+func (q *Query) Preload(names ...string) *Query {
+	q.preloads = append(q.preloads, names...)
+	return q
+}
+
+// Iterate rows, call Close if the iteration stops early
+func (q *Query) Iter(d ...Where) (*Iter, error) {
+	if q.Server == nil {
+		return nil, errors.New("DB config not found")
+	}
+	if q.err != nil {
+		return nil, q.err
+	}
+	if len(d) == 1 {
+		q.mapToWhere(d[0])
+	}
+	it, err := q.executor().IterContext(q.context(), q.ToString(), q.Args...)
+	if err != nil || q.snapshots == nil {
+		return it, err
+	}
+	it.track = q.track
+	return it, nil
+}
+
+// Call fn, a func(T) error or func(*T) error, with each row scanned into a
+// new T, stop at the first error
+func (q *Query) Each(fn interface{}) error {
+	it, err := q.Iter()
+	if err != nil {
+		return err
+	}
+	return it.Each(fn)
+}
+
+// Number of rows the select query returns
+func (q *Query) Count() (int64, error) {
+	sub := q.clone()
+	sub.Sql["Select"] = " SELECT 1 "
+	delete(sub.Sql, "ForUpdate")
+
+	c := sub.clone()
+	c.Sql = map[string]string{"Select": " SELECT COUNT(*) ", "From": fmt.Sprintf(" FROM (%s) AS %s ", sub.build(), QuoteIdentifier("t"))}
+	c.Args, c.ArgIndex, c.defaults, c.scoped = sub.Args, sub.ArgIndex, nil, nil
+
+	var n int64
+	err := c.Row(&n)
+	return n, err
+}
+
+// Whether the select query returns any row, within its Limit if set
+func (q *Query) Exists() (bool, error) {
+	c := q.clone()
+	c.Sql["Select"] = " SELECT 1 "
+	if q.Sql["Limit"] != "" {
+		sub := c
+		delete(sub.Sql, "ForUpdate")
+
+		c = sub.clone()
+		c.Sql = map[string]string{"Select": " SELECT 1 ", "From": fmt.Sprintf(" FROM (%s) AS %s ", sub.build(), QuoteIdentifier("t"))}
+		c.Args, c.ArgIndex, c.defaults, c.scoped = sub.Args, sub.ArgIndex, nil, nil
+	}
+	c.Limit(0, 1)
+
+	var n int64
+	err := c.Row(&n)
+	return n == 1, err
+}
+
+// Values of one field of all rows, ptr is a pointer to a slice like *[]int64
+func (q *Query) Pluck(f string, ptr interface{}) error {
+	return q.clone().Select(f).Rows(ptr)
+}
+
+// Copy of query
+func (q *Query) clone() *Query {
+	c := *q
+	c.Sql = make(map[string]string, len(q.Sql))
+	for k, v := range q.Sql {
+		c.Sql[k] = v
+	}
+	c.Args = append([]interface{}{}, q.Args...)
+	c.orders = append([]orderTerm{}, q.orders...)
+	c.defaults = append([]defaultCond(nil), q.defaults...)
+	c.scoped = append([]string(nil), q.scoped...)
+	c.preloads = nil // Count, Exists and Pluck load no relations
+	return &c
+}
+
+// Run the query with ctx
+func (q *Query) WithContext(ctx context.Context) *Query {
+	q.ctx = ctx
+	return q
+}
+
+// Context of the query, background if not assigned
+func (q *Query) context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
+}
+
+// Transaction if assigned, otherwise server
+func (q *Query) executor() executor {
+	if q.Tx != nil {
+		return q.Tx
+	}
+	return q.Server
 }
 
 // New Query object
@@ -5,10 +5,12 @@
 package db
 
 import (
+    "database/sql/driver"
     "fmt"
     "io/ioutil"
     "strings"
     "testing"
+    "time"
 )
 
 type QueryTest struct {
@@ -66,10 +68,10 @@ func (qt *QueryTest) Insert(t *testing.T) {
     if err != nil {
         t.Fatalf("[%s]: %v\n", qt.Query.Server.Type, err)
     }
-    qt.dataValidation(t, string(d["CreationTime"].([]byte)), "2015-01-17 00:00:00")
+    qt.dataValidation(t, d["CreationTime"], "2015-01-17 00:00:00")
     qt.dataValidation(t, d["BirthYear"], int64(1980))
-    qt.dataValidation(t, string(d["Gender"].([]byte)), "Male")
-    qt.dataValidation(t, string(d["Nickname"].([]byte)), "肯·汤普逊")
+    qt.dataValidation(t, d["Gender"], "Male")
+    qt.dataValidation(t, d["Nickname"], "肯·汤普逊")
 
     // Insert
     d = Item{
@@ -95,10 +97,10 @@ func (qt *QueryTest) Insert(t *testing.T) {
     if err != nil {
         t.Fatalf("[%s]: %v\n", qt.Query.Server.Type, err)
     }
-    qt.dataValidation(t, string(d["CreationTime"].([]byte)), "2015-01-17 01:00:00")
+    qt.dataValidation(t, d["CreationTime"], "2015-01-17 01:00:00")
     qt.dataValidation(t, d["BirthYear"], int64(1986))
-    qt.dataValidation(t, string(d["Gender"].([]byte)), "Secret")
-    qt.dataValidation(t, string(d["Nickname"].([]byte)), "阿里马马")
+    qt.dataValidation(t, d["Gender"], "Secret")
+    qt.dataValidation(t, d["Nickname"], "阿里马马")
 }
 
 func (qt *QueryTest) Update(t *testing.T) {
@@ -119,10 +121,10 @@ func (qt *QueryTest) Update(t *testing.T) {
     if err != nil {
         t.Fatalf("[%s]: %v\n", qt.Query.Server.Type, err)
     }
-    qt.dataValidation(t, string(d["CreationTime"].([]byte)), "2015-01-17 00:00:00")
+    qt.dataValidation(t, d["CreationTime"], "2015-01-17 00:00:00")
     qt.dataValidation(t, d["BirthYear"], int64(1982))
-    qt.dataValidation(t, string(d["Gender"].([]byte)), "Female")
-    qt.dataValidation(t, string(d["Nickname"].([]byte)), "Bob")
+    qt.dataValidation(t, d["Gender"], "Female")
+    qt.dataValidation(t, d["Nickname"], "Bob")
 
     // Update
     d = Item{
@@ -145,10 +147,10 @@ func (qt *QueryTest) Update(t *testing.T) {
     if err != nil {
         t.Fatalf("[%s]: %v\n", qt.Query.Server.Type, err)
     }
-    qt.dataValidation(t, string(d["CreationTime"].([]byte)), "2015-01-17 01:00:00")
+    qt.dataValidation(t, d["CreationTime"], "2015-01-17 01:00:00")
     qt.dataValidation(t, d["BirthYear"], int64(1988))
-    qt.dataValidation(t, string(d["Gender"].([]byte)), "Male")
-    qt.dataValidation(t, string(d["Nickname"].([]byte)), "C语言")
+    qt.dataValidation(t, d["Gender"], "Male")
+    qt.dataValidation(t, d["Nickname"], "C语言")
 }
 
 func (qt *QueryTest) Delete(t *testing.T) {
@@ -184,10 +186,10 @@ func (qt *QueryTest) Rows(t *testing.T) {
     if len(d) != 2 {
         t.Fatalf("[%s] Returns the number of rows of data is incorrect: %v\n", qt.Query.Server.Type, len(d))
     }
-    qt.dataValidation(t, string(d[0]["CreationTime"].([]byte)), "2015-01-17 00:00:00")
+    qt.dataValidation(t, d[0]["CreationTime"], "2015-01-17 00:00:00")
     qt.dataValidation(t, d[0]["BirthYear"], int64(1982))
-    qt.dataValidation(t, string(d[0]["Gender"].([]byte)), "Female")
-    qt.dataValidation(t, string(d[0]["Nickname"].([]byte)), "Bob")
+    qt.dataValidation(t, d[0]["Gender"], "Female")
+    qt.dataValidation(t, d[0]["Nickname"], "Bob")
 
     // Rows
     d = []Item{}
@@ -199,13 +201,17 @@ func (qt *QueryTest) Rows(t *testing.T) {
     if len(d) != 2 {
         t.Fatalf("[%s] Returns the number of rows of data is incorrect: %v\n", qt.Query.Server.Type, len(d))
     }
-    qt.dataValidation(t, string(d[0]["CreationTime"].([]byte)), "2015-01-17 00:00:00")
+    qt.dataValidation(t, d[0]["CreationTime"], "2015-01-17 00:00:00")
     qt.dataValidation(t, d[0]["BirthYear"], int64(1982))
-    qt.dataValidation(t, string(d[0]["Gender"].([]byte)), "Female")
-    qt.dataValidation(t, string(d[0]["Nickname"].([]byte)), "Bob")
+    qt.dataValidation(t, d[0]["Gender"], "Female")
+    qt.dataValidation(t, d[0]["Nickname"], "Bob")
 }
 
 func (qt *QueryTest) dataValidation(t *testing.T, l, r interface{}) {
+    // DATETIME and TIMESTAMP columns are time.Time
+    if tm, ok := l.(time.Time); ok {
+        l = tm.Format("2006-01-02 15:04:05")
+    }
     if l != r {
         t.Fatalf("[%s] Value validation fails: %v\t%v\n", qt.Query.Server.Type, l, r)
     }
@@ -235,3 +241,316 @@ func TestQuery(t *testing.T) {
     st.Load(t)
     st.Start(t)
 }
+
+func TestLimit(t *testing.T) {
+    q := NewQuery(nil).Select("UserID").From("passport_user").Limit(0, 10)
+    if str := q.ToString(); str != ` SELECT "UserID"  FROM "passport_user"  LIMIT 10 ` {
+        t.Fatalf("Limit: %q\n", str)
+    }
+    q.Limit(20, 10)
+    if str := q.ToString(); str != ` SELECT "UserID"  FROM "passport_user"  LIMIT 10 OFFSET 20 ` {
+        t.Fatalf("Limit: %q\n", str)
+    }
+
+    // "LIMIT offset, rows" of MySQL is a syntax error on PostgreSQL, OFFSET runs on all
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    s := qt.Query.Server
+    for _, v := range []string{"Bob", "Alice", "Carol"} {
+        if _, err := s.InsertInto("passport_user").Exec(Item{"CreationTime": "2015-01-17 00:00:00", "BirthYear": 1980, "Gender": "Male", "Nickname": v}); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+    type user struct {
+        Nickname string
+    }
+    d := []user{}
+    if err := s.Select("Nickname").From("passport_user").OrderAsc("UserID").Limit(1, 1).Rows(&d); err != nil || len(d) != 1 || d[0].Nickname != "Alice" {
+        t.Fatalf("[%s]: %v %v\n", s.Type, d, err)
+    }
+}
+
+func TestQuoteField(t *testing.T) {
+    q := NewQuery(nil)
+    fields := map[string]string{
+        "Nickname":           `"Nickname"`,
+        " u.Nickname ":       `"u"."Nickname"`,
+        "u.*":                `"u".*`,
+        "*":                  `*`,
+        "Nickname AS n":      `"Nickname" AS "n"`,
+        "u.Nickname as Name": `"u"."Nickname" AS "Name"`,
+        `a"b`:                `"a""b"`,
+        `x" FROM t; --`:      `"x"" FROM t; --"`,
+        "UserID AS \"x\" --": `"UserID" AS """x"" --"`,
+    }
+    for f, want := range fields {
+        if got := q.quoteField(f); got != want {
+            t.Fatalf("quoteField(%q): %s, want %s\n", f, got, want)
+        }
+    }
+    if q.err != nil {
+        t.Fatalf("unexpected error: %v\n", q.err)
+    }
+
+    q = NewQuery(NewServer("sqlite3", "sqlite3.db"))
+    q.Select("a\x00b").From("passport_user")
+    if err := q.Rows(&[]Item{}); err == nil {
+        t.Fatalf("identifier with NUL byte must be rejected\n")
+    }
+}
+
+func TestOrderBy(t *testing.T) {
+    q := NewQuery(NewServer("postgres", ""))
+    q.OrderDesc("a").OrderAsc("b", "c").NullsLast().OrderBy("d desc nulls first", "e")
+    want := ` ORDER BY "a" DESC, "b" ASC NULLS LAST, "c" ASC NULLS LAST, "d" DESC NULLS FIRST, "e" ASC `
+    if q.Sql["Order"] != want {
+        t.Fatalf("[postgres]: %s\n", q.Sql["Order"])
+    }
+
+    q = NewQuery(NewServer("mysql", ""))
+    q.OrderAsc("a").NullsLast().OrderDescExpr("FIELD(Gender, ?, ?)", "Male", "Female").NullsFirst()
+    want = ` ORDER BY "a" IS NULL, "a" ASC, (FIELD(Gender, $1, $2)) IS NOT NULL, FIELD(Gender, $1, $2) DESC `
+    if q.Sql["Order"] != want {
+        t.Fatalf("[mysql]: %s\n", q.Sql["Order"])
+    }
+    if len(q.Args) != 2 || q.Args[0] != "Male" || q.Args[1] != "Female" {
+        t.Fatalf("[mysql]: %#v\n", q.Args)
+    }
+
+    q = NewQuery(NewServer("sqlite3", ""))
+    q.OrderBy("a NULLS MIDDLE")
+    if q.err == nil {
+        t.Fatalf("[sqlite3]: invalid NULLS must be rejected\n")
+    }
+}
+
+func TestForUpdate(t *testing.T) {
+    q := NewQuery(NewServer("postgres", ""))
+    q.Select("*").From("passport_user").Where(q.Eq("UserID", 1000000)).ForUpdate().SkipLocked()
+    if q.Sql["ForUpdate"] != " FOR UPDATE SKIP LOCKED " {
+        t.Fatalf("[postgres]: %s\n", q.Sql["ForUpdate"])
+    }
+
+    q = NewQuery(NewServer("mysql", ""))
+    q.Select("*").From("passport_user").ForShare()
+    if q.Sql["ForUpdate"] != " LOCK IN SHARE MODE " {
+        t.Fatalf("[mysql]: %s\n", q.Sql["ForUpdate"])
+    }
+    q = NewQuery(NewServer("postgres", ""))
+    q.Select("*").From("passport_user").ForShare()
+    if q.Sql["ForUpdate"] != " FOR SHARE " {
+        t.Fatalf("[postgres]: %s\n", q.Sql["ForUpdate"])
+    }
+
+    q = NewQuery(NewServer("mysql", ""))
+    q.Select("*").From("passport_user").ForShare().NoWait()
+    if q.Sql["ForUpdate"] != " FOR SHARE NOWAIT " {
+        t.Fatalf("[mysql]: %s\n", q.Sql["ForUpdate"])
+    }
+
+    q = NewQuery(NewServer("sqlite3", "sqlite3.db"))
+    err := q.Select("*").From("passport_user").ForUpdate().Rows(&[]Item{})
+    if err != ErrLockNotSupported {
+        t.Fatalf("[sqlite3]: %v\n", err)
+    }
+}
+
+func TestScalar(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    s := qt.Query.Server
+
+    q := s.InsertInto("passport_user").Fields("UserID", "CreationTime", "BirthYear", "Gender", "Nickname")
+    q.Values(1000000, "2015-01-17 00:00:00", 1980, "Male", "Bob").Values(1000001, "2015-01-17 01:00:00", 1986, "Female", "Alice")
+    if _, err := q.Exec(); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+
+    // Row and Rows into scalars
+    var year int64
+    if err := s.Row(&year, `SELECT MAX("BirthYear") FROM "passport_user"`); err != nil || year != 1986 {
+        t.Fatalf("[%s]: %v %v\n", s.Type, year, err)
+    }
+    var nickname *string
+    if err := s.Row(&nickname, `SELECT NULL`); err != nil || nickname != nil {
+        t.Fatalf("[%s]: %v %v\n", s.Type, nickname, err)
+    }
+    ids := []int64{}
+    if err := s.Rows(&ids, `SELECT "UserID" FROM "passport_user" ORDER BY "UserID"`); err != nil || len(ids) != 2 || ids[1] != 1000001 {
+        t.Fatalf("[%s]: %v %v\n", s.Type, ids, err)
+    }
+    if err := s.Rows(&ids, `SELECT "UserID", "Nickname" FROM "passport_user"`); err == nil {
+        t.Fatalf("[%s]: two columns into []int64 must be an error\n", s.Type)
+    }
+
+    // Count, Pluck, Exists
+    q = s.Select().From("passport_user")
+    q.Where(q.Ge("BirthYear", 1980)).OrderDesc("UserID")
+    n, err := q.Count()
+    if err != nil || n != 2 {
+        t.Fatalf("[%s] Count: %v %v\n", s.Type, n, err)
+    }
+    names := []string{}
+    if err := q.Pluck("Nickname", &names); err != nil || len(names) != 2 || names[0] != "Alice" {
+        t.Fatalf("[%s] Pluck: %v %v\n", s.Type, names, err)
+    }
+    n, err = q.Limit(0, 1).Count()
+    if err != nil || n != 1 {
+        t.Fatalf("[%s] Count: %v %v\n", s.Type, n, err)
+    }
+
+    q = s.Select().From("passport_user")
+    ok, err := q.Where(q.Eq("Nickname", "Bob")).Exists()
+    if err != nil || !ok {
+        t.Fatalf("[%s] Exists: %v %v\n", s.Type, ok, err)
+    }
+    q = s.Select().From("passport_user")
+    ok, err = q.Where(q.Eq("Nickname", "Carol")).Exists()
+    if err != nil || ok {
+        t.Fatalf("[%s] Exists: %v %v\n", s.Type, ok, err)
+    }
+
+    // Exists keeps the offset: 2 rows, none after the second
+    q = s.Select().From("passport_user")
+    q.Where(q.Ge("BirthYear", 1980))
+    if ok, err = q.Limit(1, 5).Exists(); err != nil || !ok {
+        t.Fatalf("[%s] Exists: %v %v\n", s.Type, ok, err)
+    }
+    if ok, err = q.Limit(2, 5).Exists(); err != nil || ok {
+        t.Fatalf("[%s] Exists: offset: %v %v\n", s.Type, ok, err)
+    }
+}
+
+type docStatus int
+
+func (s docStatus) Value() (driver.Value, error) {
+    return []string{"draft", "published"}[s], nil
+}
+
+func (s *docStatus) Scan(src interface{}) error {
+    switch fmt.Sprintf("%s", src) {
+    case "draft":
+        *s = 0
+    case "published":
+        *s = 1
+    default:
+        return fmt.Errorf("invalid status %v", src)
+    }
+    return nil
+}
+
+type jsonDoc struct {
+    DocID  int64
+    Status docStatus
+    Tags   []string               `db:",json"`
+    Meta   map[string]int         `db:",json"`
+    Author *struct{ Name string } `db:"AuthorJSON,json"`
+}
+
+func TestJSONField(t *testing.T) {
+    s := NewServer("sqlite3", "sqlite3.db")
+    for _, v := range []string{`DROP TABLE IF EXISTS "json_doc"`, `CREATE TABLE "json_doc" ("DocID" INTEGER PRIMARY KEY, "Status" TEXT NOT NULL, "Tags" TEXT, "Meta" TEXT, "AuthorJSON" TEXT)`} {
+        if _, err := s.Exec(v); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+
+    d := jsonDoc{DocID: 1, Status: 1, Tags: []string{"a", "b"}, Meta: map[string]int{"views": 3}, Author: &struct{ Name string }{"Bob"}}
+    if _, err := s.InsertInto("json_doc").Exec(&d); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    if _, err := s.InsertInto("json_doc").Exec(jsonDoc{DocID: 2}); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+
+    item := Item{}
+    if err := s.Select("*").From("json_doc").Row(&item, Where{"DocID": 1}); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    if item["Status"] != "published" || item["Tags"] != `["a","b"]` || item["Meta"] != `{"views":3}` {
+        t.Fatalf("[%s]: %v\n", s.Type, item)
+    }
+
+    r := []jsonDoc{}
+    if err := s.Select("*").From("json_doc").OrderAsc("DocID").Rows(&r); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    if len(r) != 2 || r[0].Status != 1 || len(r[0].Tags) != 2 || r[0].Meta["views"] != 3 || r[0].Author.Name != "Bob" {
+        t.Fatalf("[%s]: %#v\n", s.Type, r)
+    }
+    if r[1].Status != 0 || r[1].Tags != nil || r[1].Meta != nil || r[1].Author != nil {
+        t.Fatalf("[%s]: %#v\n", s.Type, r[1])
+    }
+
+    // Update from struct
+    d.Tags = append(d.Tags, "c")
+    if _, err := s.Update("json_doc").Exec(d, Where{"DocID": 1}); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    if err := s.Select("*").From("json_doc").Row(&d, Where{"DocID": 1}); err != nil || len(d.Tags) != 3 {
+        t.Fatalf("[%s]: %v %v\n", s.Type, d.Tags, err)
+    }
+}
+
+func TestIter(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    s := qt.Query.Server
+
+    q := s.InsertInto("passport_user").Fields("UserID", "CreationTime", "BirthYear", "Gender", "Nickname")
+    for i := 0; i < 3; i++ {
+        q.Values(1000000+i, "2015-01-17 00:00:00", 1980+i, "Male", fmt.Sprintf("User%d", i))
+    }
+    if _, err := q.Exec(); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+
+    type user struct {
+        UserID   int64
+        Nickname string
+    }
+
+    // Next, Scan
+    it, err := s.Select("UserID", "Nickname").From("passport_user").OrderAsc("UserID").Iter()
+    if err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    ids := []int64{}
+    for it.Next() {
+        u := user{}
+        if err := it.Scan(&u); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+        ids = append(ids, u.UserID)
+    }
+    if it.Err() != nil || len(ids) != 3 || ids[2] != 1000002 {
+        t.Fatalf("[%s]: %v %v\n", s.Type, ids, it.Err())
+    }
+
+    // Each, stops at the first error
+    names := []string{}
+    err = s.Select("UserID", "Nickname").From("passport_user").OrderAsc("UserID").Each(func(u user) error {
+        names = append(names, u.Nickname)
+        if len(names) == 2 {
+            return fmt.Errorf("stop")
+        }
+        return nil
+    })
+    if err == nil || err.Error() != "stop" || len(names) != 2 || names[1] != "User1" {
+        t.Fatalf("[%s]: %v %v\n", s.Type, names, err)
+    }
+
+    // Each, a new row per call
+    rows := []*user{}
+    err = s.Select("UserID", "Nickname").From("passport_user").OrderAsc("UserID").Each(func(u *user) error {
+        rows = append(rows, u)
+        return nil
+    })
+    if err != nil || len(rows) != 3 || rows[0] == rows[1] || rows[0].UserID == rows[1].UserID {
+        t.Fatalf("[%s]: %v %v\n", s.Type, rows, err)
+    }
+
+    if err := s.Select("UserID").From("passport_user").Each(func() error { return nil }); err == nil {
+        t.Fatalf("[%s]: Each: fn without row\n", s.Type)
+    }
+}
@@ -0,0 +1,443 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package queue is a database-backed job queue built on db.Server.
+//
+// Workers claim batches of ready jobs with SELECT ... FOR UPDATE SKIP LOCKED
+// on MySQL and PostgreSQL, and with a single atomic UPDATE that stamps a claim
+// token on sqlite3. A claimed job is leased for Queue.Lease; the worker keeps
+// it with Heartbeat, removes it with Ack, or hands it back with Fail, which
+// schedules a retry with backoff or moves it to the dead letter state after
+// MaxAttempts.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhgo/db"
+)
+
+// Job status
+const (
+	StatusReady   = "ready"
+	StatusRunning = "running"
+	StatusDead    = "dead"
+)
+
+// The job is no longer claimed by the caller: the lease expired and another worker claimed it, or it was acked.
+var ErrLostClaim = errors.New("queue: job is no longer claimed by this worker")
+
+// Job
+type Job struct {
+	// Primary key
+	JobID int64
+
+	// Queue name
+	Queue string
+
+	// Job data
+	Payload string
+
+	// Status: ready, running, dead
+	Status string
+
+	// Number of claims so far, including the current one
+	Attempts int64
+
+	// Attempts before the job is dead
+	MaxAttempts int64
+
+	// Earliest time the job can be claimed
+	RunAt time.Time
+
+	// Token of the current claim
+	ClaimToken string
+
+	// Error of the last failed attempt
+	LastError string
+}
+
+// Queue
+type Queue struct {
+	// Server
+	Server *db.Server
+
+	// Job table name
+	Table string
+
+	// Queue name, many queues can share one table
+	Name string
+
+	// How long a claim is valid without heartbeat
+	Lease time.Duration
+
+	// Default attempts for new jobs
+	MaxAttempts int64
+
+	// Delay before retry after the given failed attempt
+	Backoff func(attempts int64) time.Duration
+
+	// Clock
+	Now func() time.Time
+}
+
+// Job table columns
+var jobFields = []string{"JobID", "Queue", "Payload", "Status", "Attempts", "MaxAttempts", "RunAt", "ClaimToken", "LastError"}
+
+// Job table DDL
+var schemas = map[string][]string{
+	"mysql": []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+  "JobID" bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  "Queue" varchar(64) NOT NULL,
+  "Payload" longtext NOT NULL,
+  "Status" varchar(16) NOT NULL,
+  "Attempts" int(10) NOT NULL DEFAULT 0,
+  "MaxAttempts" int(10) NOT NULL,
+  "RunAt" bigint(20) NOT NULL,
+  "LockedUntil" bigint(20) NOT NULL DEFAULT 0,
+  "ClaimToken" varchar(64) NOT NULL DEFAULT '',
+  "LastError" text,
+  "CreationTime" bigint(20) NOT NULL,
+  PRIMARY KEY ("JobID"),
+  KEY "Claim" ("Queue", "Status", "RunAt")
+) ENGINE=InnoDB DEFAULT CHARSET=utf8`},
+	"postgres": []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+    "JobID" BIGSERIAL PRIMARY KEY,
+    "Queue" varchar(64) NOT NULL,
+    "Payload" text NOT NULL,
+    "Status" varchar(16) NOT NULL,
+    "Attempts" integer NOT NULL DEFAULT 0,
+    "MaxAttempts" integer NOT NULL,
+    "RunAt" bigint NOT NULL,
+    "LockedUntil" bigint NOT NULL DEFAULT 0,
+    "ClaimToken" varchar(64) NOT NULL DEFAULT '',
+    "LastError" text,
+    "CreationTime" bigint NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s ("Queue", "Status", "RunAt")`},
+	"sqlite3": []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+  "JobID" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+  "Queue" TEXT NOT NULL,
+  "Payload" TEXT NOT NULL,
+  "Status" TEXT NOT NULL,
+  "Attempts" INTEGER NOT NULL DEFAULT 0,
+  "MaxAttempts" INTEGER NOT NULL,
+  "RunAt" INTEGER NOT NULL,
+  "LockedUntil" INTEGER NOT NULL DEFAULT 0,
+  "ClaimToken" TEXT NOT NULL DEFAULT '',
+  "LastError" TEXT,
+  "CreationTime" INTEGER NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s ("Queue", "Status", "RunAt")`}}
+
+// Create job table if not exists
+func (q *Queue) CreateTable() error {
+	stmts, ok := schemas[q.Server.Type]
+	if !ok {
+		return fmt.Errorf("queue: unsupported database type %q", q.Server.Type)
+	}
+
+	for _, v := range stmts {
+		str := fmt.Sprintf(v, db.QuoteIdentifier(q.Table), db.QuoteIdentifier(q.Table+"_Claim"))
+		if _, err := q.Server.Exec(str); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add a job, ready now
+func (q *Queue) Enqueue(payload string) (int64, error) {
+	return q.enqueue(q.Server.NewQuery(), payload, q.Now())
+}
+
+// Add a job, ready at the given time
+func (q *Queue) EnqueueAt(payload string, at time.Time) (int64, error) {
+	return q.enqueue(q.Server.NewQuery(), payload, at)
+}
+
+// Add a job in a transaction, it becomes visible to workers when tx commits
+func (q *Queue) EnqueueTx(tx *db.Tx, payload string) (int64, error) {
+	return q.enqueue(tx.NewQuery(), payload, q.Now())
+}
+
+// enqueue
+func (q *Queue) enqueue(query *db.Query, payload string, at time.Time) (int64, error) {
+	query.SetPrimary("JobID") // PostgreSQL compatibility
+	query.InsertInto(q.Table)
+	query.Fields("Queue", "Payload", "Status", "Attempts", "MaxAttempts", "RunAt", "LockedUntil", "ClaimToken", "CreationTime")
+	query.Values(q.Name, payload, StatusReady, 0, q.MaxAttempts, millis(at), 0, "", millis(q.Now()))
+	r, err := query.Exec()
+	if err != nil {
+		return 0, err
+	}
+	return r.LastInsertId, nil
+}
+
+// Claim up to n ready jobs. Each returned job must be acked or failed before its lease expires.
+func (q *Queue) Claim(n int) ([]*Job, error) {
+	now := q.Now()
+	if err := q.releaseExpired(now); err != nil {
+		return nil, err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Server.Type == "sqlite3" {
+		return q.claimUpdate(n, now, token)
+	}
+	return q.claimLocked(n, now, token)
+}
+
+// Claim with SELECT ... FOR UPDATE SKIP LOCKED, concurrent workers never see the same rows.
+func (q *Queue) claimLocked(n int, now time.Time, token string) ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	err := q.Server.Transaction(func(tx *db.Tx) error {
+		d := []db.Item{}
+		s := tx.Select(jobFields...).From(q.Table)
+		s.Where(s.Eq("Queue", q.Name), s.AndEq("Status", StatusReady), s.AndLe("RunAt", millis(now)))
+		err := s.OrderAsc("RunAt", "JobID").Limit(0, int64(n)).ForUpdate().SkipLocked().Rows(&d)
+		if err != nil || len(d) == 0 {
+			return err
+		}
+
+		args := []interface{}{StatusRunning, token, millis(now.Add(q.Lease))}
+		ph := make([]string, len(d))
+		for i, v := range d {
+			args = append(args, v["JobID"])
+			ph[i] = fmt.Sprintf("$%d", len(args))
+		}
+
+		str := fmt.Sprintf(`UPDATE %s SET "Status" = $1, "ClaimToken" = $2, "LockedUntil" = $3, "Attempts" = "Attempts" + 1 WHERE "JobID" IN (%s)`,
+			db.QuoteIdentifier(q.Table), strings.Join(ph, ", "))
+		if _, err := tx.Exec(str, args...); err != nil {
+			return err
+		}
+
+		for _, v := range d {
+			job := toJob(v)
+			job.Status = StatusRunning
+			job.Attempts++
+			job.ClaimToken = token
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Claim with one atomic UPDATE that stamps the claim token, then read the claimed rows back.
+func (q *Queue) claimUpdate(n int, now time.Time, token string) ([]*Job, error) {
+	t := db.QuoteIdentifier(q.Table)
+	str := fmt.Sprintf(`UPDATE %[1]s SET "Status" = $1, "ClaimToken" = $2, "LockedUntil" = $3, "Attempts" = "Attempts" + 1
+WHERE "JobID" IN (SELECT "JobID" FROM %[1]s WHERE "Queue" = $4 AND "Status" = $5 AND "RunAt" <= $6 ORDER BY "RunAt" ASC, "JobID" ASC LIMIT %[2]d)`, t, n)
+	_, err := q.Server.Exec(str, StatusRunning, token, millis(now.Add(q.Lease)), q.Name, StatusReady, millis(now))
+	if err != nil {
+		return nil, err
+	}
+
+	d := []db.Item{}
+	s := q.Server.Select(jobFields...).From(q.Table)
+	err = s.Where(s.Eq("ClaimToken", token)).OrderAsc("RunAt", "JobID").Rows(&d)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, len(d))
+	for i, v := range d {
+		jobs[i] = toJob(v)
+	}
+	return jobs, nil
+}
+
+// Jobs whose lease expired go back to ready, or to dead when out of attempts.
+func (q *Queue) releaseExpired(now time.Time) error {
+	t := db.QuoteIdentifier(q.Table)
+	str := fmt.Sprintf(`UPDATE %s SET "Status" = $1, "ClaimToken" = '', "LockedUntil" = 0, "LastError" = $2
+WHERE "Queue" = $3 AND "Status" = $4 AND "LockedUntil" < $5 AND "Attempts" >= "MaxAttempts"`, t)
+	_, err := q.Server.Exec(str, StatusDead, "lease expired", q.Name, StatusRunning, millis(now))
+	if err != nil {
+		return err
+	}
+
+	str = fmt.Sprintf(`UPDATE %s SET "Status" = $1, "ClaimToken" = '', "LockedUntil" = 0
+WHERE "Queue" = $2 AND "Status" = $3 AND "LockedUntil" < $4`, t)
+	_, err = q.Server.Exec(str, StatusReady, q.Name, StatusRunning, millis(now))
+	return err
+}
+
+// Extend the lease of a claimed job
+func (q *Queue) Heartbeat(job *Job) error {
+	u := q.Server.Update(q.Table).Set("LockedUntil", millis(q.Now().Add(q.Lease)))
+	return q.claimed(u.Where(u.Eq("JobID", job.JobID), u.AndEq("ClaimToken", job.ClaimToken), u.AndEq("Status", StatusRunning)))
+}
+
+// Job is done, remove it
+func (q *Queue) Ack(job *Job) error {
+	d := q.Server.DeleteFrom(q.Table)
+	return q.claimed(d.Where(d.Eq("JobID", job.JobID), d.AndEq("ClaimToken", job.ClaimToken), d.AndEq("Status", StatusRunning)))
+}
+
+// Job failed, retry after backoff or move it to dead letter when out of attempts
+func (q *Queue) Fail(job *Job, cause error) error {
+	msg := ""
+	if cause != nil {
+		msg = cause.Error()
+	}
+
+	u := q.Server.Update(q.Table)
+	if job.Attempts >= job.MaxAttempts {
+		u.Set("Status", StatusDead)
+		job.Status = StatusDead
+	} else {
+		job.RunAt = q.Now().Add(q.Backoff(job.Attempts))
+		u.Set("Status", StatusReady).Set("RunAt", millis(job.RunAt))
+		job.Status = StatusReady
+	}
+	u.Set("ClaimToken", "").Set("LockedUntil", 0).Set("LastError", msg)
+	job.LastError = msg
+
+	return q.claimed(u.Where(u.Eq("JobID", job.JobID), u.AndEq("ClaimToken", job.ClaimToken), u.AndEq("Status", StatusRunning)))
+}
+
+// Dead jobs, oldest first
+func (q *Queue) Dead(limit int64) ([]*Job, error) {
+	d := []db.Item{}
+	s := q.Server.Select(jobFields...).From(q.Table)
+	err := s.Where(s.Eq("Queue", q.Name), s.AndEq("Status", StatusDead)).OrderAsc("JobID").Limit(0, limit).Rows(&d)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, len(d))
+	for i, v := range d {
+		jobs[i] = toJob(v)
+	}
+	return jobs, nil
+}
+
+// Move a dead job back to ready with fresh attempts
+func (q *Queue) Retry(jobID int64) error {
+	u := q.Server.Update(q.Table).Set("Status", StatusReady).Set("Attempts", 0).Set("RunAt", millis(q.Now()))
+	r, err := u.Where(u.Eq("JobID", jobID), u.AndEq("Status", StatusDead)).Exec()
+	if err != nil {
+		return err
+	}
+	if r.RowsAffected == 0 {
+		return fmt.Errorf("queue: no dead job %d", jobID)
+	}
+	return nil
+}
+
+// Execute a statement guarded by claim token
+func (q *Queue) claimed(query *db.Query) error {
+	r, err := query.Exec()
+	if err != nil {
+		return err
+	}
+	if r.RowsAffected == 0 {
+		return ErrLostClaim
+	}
+	return nil
+}
+
+// Default backoff: 1s, 2s, 4s ... up to 1h
+func Backoff(attempts int64) time.Duration {
+	if attempts > 12 {
+		return time.Hour
+	}
+	d := time.Second << uint(attempts-1)
+	if d > time.Hour || d <= 0 {
+		return time.Hour
+	}
+	return d
+}
+
+// New Queue, using table "queue_job"
+func New(server *db.Server, name string) *Queue {
+	return &Queue{
+		Server:      server,
+		Table:       "queue_job",
+		Name:        name,
+		Lease:       30 * time.Second,
+		MaxAttempts: 5,
+		Backoff:     Backoff,
+		Now:         time.Now,
+	}
+}
+
+// Random claim token
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Unix milliseconds
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Item to Job
+func toJob(d db.Item) *Job {
+	return &Job{
+		JobID:       toInt64(d["JobID"]),
+		Queue:       toString(d["Queue"]),
+		Payload:     toString(d["Payload"]),
+		Status:      toString(d["Status"]),
+		Attempts:    toInt64(d["Attempts"]),
+		MaxAttempts: toInt64(d["MaxAttempts"]),
+		RunAt:       time.Unix(0, toInt64(d["RunAt"])*int64(time.Millisecond)),
+		ClaimToken:  toString(d["ClaimToken"]),
+		LastError:   toString(d["LastError"]),
+	}
+}
+
+// Driver value to string, NULL is ""
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// Driver value to int64, MySQL may return numbers as []byte
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case []byte:
+		i, _ := strconv.ParseInt(string(v), 10, 64)
+		return i
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	}
+	return 0
+}
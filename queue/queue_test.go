@@ -0,0 +1,135 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhgo/db"
+)
+
+func newTestQueue(t *testing.T) (*Queue, *time.Time) {
+	s := db.NewServer("sqlite3", "sqlite3.db")
+	if _, err := s.Exec(`DROP TABLE IF EXISTS "queue_job"`); err != nil {
+		t.Fatalf("[%s]: %v\n", s.Type, err)
+	}
+
+	now := time.Date(2015, 1, 17, 0, 0, 0, 0, time.UTC)
+	q := New(s, "mail")
+	q.MaxAttempts = 2
+	q.Now = func() time.Time { return now }
+	if err := q.CreateTable(); err != nil {
+		t.Fatalf("[%s]: %v\n", s.Type, err)
+	}
+	return q, &now
+}
+
+func TestQueue(t *testing.T) {
+	q, now := newTestQueue(t)
+
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := q.Enqueue(v); err != nil {
+			t.Fatalf("Enqueue: %v\n", err)
+		}
+	}
+	if _, err := q.EnqueueAt("later", now.Add(time.Hour)); err != nil {
+		t.Fatalf("EnqueueAt: %v\n", err)
+	}
+
+	// Claim in batches, a job is never claimed twice
+	jobs, err := q.Claim(2)
+	if err != nil {
+		t.Fatalf("Claim: %v\n", err)
+	}
+	if len(jobs) != 2 || jobs[0].Payload != "a" || jobs[1].Payload != "b" || jobs[0].Attempts != 1 {
+		t.Fatalf("Claim: %#v\n", jobs)
+	}
+	rest, err := q.Claim(10)
+	if err != nil {
+		t.Fatalf("Claim: %v\n", err)
+	}
+	if len(rest) != 1 || rest[0].Payload != "c" {
+		t.Fatalf("Claim: %#v\n", rest)
+	}
+
+	// Ack and heartbeat
+	if err := q.Ack(jobs[0]); err != nil {
+		t.Fatalf("Ack: %v\n", err)
+	}
+	if err := q.Ack(jobs[0]); err != ErrLostClaim {
+		t.Fatalf("Ack twice: %v\n", err)
+	}
+	if err := q.Heartbeat(jobs[1]); err != nil {
+		t.Fatalf("Heartbeat: %v\n", err)
+	}
+
+	// Fail, retried after backoff
+	if err := q.Fail(rest[0], errors.New("smtp down")); err != nil {
+		t.Fatalf("Fail: %v\n", err)
+	}
+	if jobs, _ := q.Claim(10); len(jobs) != 0 {
+		t.Fatalf("Claim during backoff: %#v\n", jobs)
+	}
+	*now = now.Add(Backoff(1))
+	retry, err := q.Claim(10)
+	if err != nil || len(retry) != 1 || retry[0].Payload != "c" || retry[0].Attempts != 2 || retry[0].LastError != "smtp down" {
+		t.Fatalf("Claim retry: %#v %v\n", retry, err)
+	}
+
+	// Out of attempts, dead letter
+	if err := q.Fail(retry[0], errors.New("smtp down again")); err != nil {
+		t.Fatalf("Fail: %v\n", err)
+	}
+	dead, err := q.Dead(10)
+	if err != nil || len(dead) != 1 || dead[0].Payload != "c" || dead[0].Status != StatusDead {
+		t.Fatalf("Dead: %#v %v\n", dead, err)
+	}
+
+	// Lease expired, job is claimed again and the old claim is lost
+	*now = now.Add(time.Hour)
+	again, err := q.Claim(10)
+	if err != nil || len(again) != 2 || again[0].Payload != "b" || again[1].Payload != "later" {
+		t.Fatalf("Claim expired: %#v %v\n", again, err)
+	}
+	if err := q.Ack(jobs[1]); err != ErrLostClaim {
+		t.Fatalf("Ack expired claim: %v\n", err)
+	}
+
+	// Dead job back to ready
+	if err := q.Retry(dead[0].JobID); err != nil {
+		t.Fatalf("Retry: %v\n", err)
+	}
+	revived, err := q.Claim(10)
+	if err != nil || len(revived) != 1 || revived[0].Payload != "c" || revived[0].Attempts != 1 {
+		t.Fatalf("Claim revived: %#v %v\n", revived, err)
+	}
+}
+
+func TestEnqueueTx(t *testing.T) {
+	q, _ := newTestQueue(t)
+
+	err := q.Server.Transaction(func(tx *db.Tx) error {
+		if _, err := q.EnqueueTx(tx, "rolled back"); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	if err == nil || err.Error() != "abort" {
+		t.Fatalf("Transaction: %v\n", err)
+	}
+
+	jobs, err := q.Claim(10)
+	if err != nil || len(jobs) != 0 {
+		t.Fatalf("Claim: %#v %v\n", jobs, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if Backoff(1) != time.Second || Backoff(3) != 4*time.Second || Backoff(100) != time.Hour {
+		t.Fatalf("Backoff: %v %v %v\n", Backoff(1), Backoff(3), Backoff(100))
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Keys per IN list of a preload query, below the parameter limits of the
+// databases (SQLite 999 before 3.32)
+var preloadBatch = 500
+
+// Kind of relation between tables
+type RelationKind int
+
+const (
+	// One row of the related table has a foreign key to this table
+	HasOne RelationKind = iota
+
+	// Rows of the related table have a foreign key to this table
+	HasMany
+
+	// This table has a foreign key to the related table
+	BelongsTo
+
+	// Rows of both tables are related through a join table
+	ManyToMany
+)
+
+// Relation of a table to another, loaded into a struct field by Query.Preload
+type Relation struct {
+	// Struct field of the related entities: T or *T for HasOne and BelongsTo,
+	// []T or []*T for HasMany and ManyToMany
+	Name string
+
+	// Kind of relation
+	Kind RelationKind
+
+	// Related table
+	Table *Table
+
+	// HasOne, HasMany: column of the related table referencing the primary key of this table.
+	// BelongsTo: column of this table referencing the primary key of the related table.
+	// ManyToMany: column of the join table referencing the primary key of this table.
+	ForeignKey string
+
+	// Join table of ManyToMany
+	JoinTable string
+
+	// Column of the join table referencing the primary key of the related table
+	JoinKey string
+}
+
+// Field name has one row of related, whose foreignKey references the primary key of t
+func (t *Table) HasOne(name string, related *Table, foreignKey string) *Table {
+	return t.relate(Relation{Name: name, Kind: HasOne, Table: related, ForeignKey: foreignKey})
+}
+
+// Field name has the rows of related whose foreignKey references the primary key of t
+func (t *Table) HasMany(name string, related *Table, foreignKey string) *Table {
+	return t.relate(Relation{Name: name, Kind: HasMany, Table: related, ForeignKey: foreignKey})
+}
+
+// Field name has the row of related referenced by foreignKey of t
+func (t *Table) BelongsTo(name string, related *Table, foreignKey string) *Table {
+	return t.relate(Relation{Name: name, Kind: BelongsTo, Table: related, ForeignKey: foreignKey})
+}
+
+// Field name has the rows of related joined by joinTable, whose foreignKey
+// references the primary key of t and joinKey the primary key of related
+func (t *Table) ManyToMany(name string, related *Table, joinTable, foreignKey, joinKey string) *Table {
+	return t.relate(Relation{Name: name, Kind: ManyToMany, Table: related, ForeignKey: foreignKey, JoinTable: joinTable, JoinKey: joinKey})
+}
+
+// Add or replace relation r
+func (t *Table) relate(r Relation) *Table {
+	for i := range t.Relations {
+		if t.Relations[i].Name == r.Name {
+			t.Relations[i] = r
+			return t
+		}
+	}
+	t.Relations = append(t.Relations, r)
+	return t
+}
+
+// Relation by name
+func (t *Table) Relation(name string) (Relation, bool) {
+	for _, r := range t.Relations {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Relation{}, false
+}
+
+// The only primary key column
+func (t *Table) singlePrimary() (string, error) {
+	ps := t.primaries()
+	if len(ps) != 1 {
+		return "", fmt.Errorf("table %s: relations need a primary key of one column", t.Name)
+	}
+	return ps[0], nil
+}
+
+// Index of the relation field
+func (t *Table) relationField(r Relation) ([]int, error) {
+	for _, f := range structFields(t.EntityType) {
+		if f.Nested && f.Name == r.Name {
+			return f.Index, nil
+		}
+	}
+	return nil, fmt.Errorf("table %s: entity has no field %s for the relation", t.Name, r.Name)
+}
+
+// Index of the field of column
+func (t *Table) columnField(name string) ([]int, error) {
+	c, ok := t.Column(name)
+	if !ok {
+		return nil, fmt.Errorf("table %s has no column %s", t.Name, name)
+	}
+	return c.index, nil
+}
+
+// Load relations into entities scanned into ptr, a pointer to an entity or a slice of them
+func (q *Query) preload(ptr interface{}) error {
+	if q.Table == nil {
+		return errors.New("preload needs the Table of the query")
+	}
+
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("ptr is not a pointer")
+	}
+
+	var entities []reflect.Value
+	v = v.Elem()
+	if v.Kind() == reflect.Slice {
+		entities = make([]reflect.Value, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if e := reflect.Indirect(v.Index(i)); e.IsValid() {
+				entities = append(entities, e)
+			}
+		}
+	} else {
+		entities = []reflect.Value{v}
+	}
+
+	for _, e := range entities {
+		if e.Type() != q.Table.EntityType {
+			return fmt.Errorf("entity is %s, not %s", e.Type(), q.Table.EntityType)
+		}
+	}
+	return q.loadRelations(q.Table, entities, q.preloads)
+}
+
+// Load relations of t, nested ones are separated by dots like "Roles.Permissions"
+func (q *Query) loadRelations(t *Table, entities []reflect.Value, names []string) error {
+	order := make([]string, 0, len(names))
+	nested := make(map[string][]string)
+	for _, n := range names {
+		p := strings.SplitN(n, ".", 2)
+		if _, ok := nested[p[0]]; !ok {
+			order = append(order, p[0])
+			nested[p[0]] = nil
+		}
+		if len(p) == 2 {
+			nested[p[0]] = append(nested[p[0]], p[1])
+		}
+	}
+
+	for _, name := range order {
+		r, ok := t.Relation(name)
+		if !ok {
+			return fmt.Errorf("table %s has no relation %s", t.Name, name)
+		}
+		if err := q.loadRelation(t, r, entities, nested[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load relation r of entities of t with one query, and one more on the join table,
+// per preloadBatch keys. Soft deleted rows of the related table are left out,
+// entities with a zero or NULL key get none.
+func (q *Query) loadRelation(t *Table, r Relation, entities []reflect.Value, nested []string) error {
+	field, err := t.relationField(r)
+	if err != nil {
+		return err
+	}
+
+	// Column of t holding the key, column of the related table matching it
+	var key, relatedKey string
+	switch r.Kind {
+	case BelongsTo:
+		key = r.ForeignKey
+		relatedKey, err = r.Table.singlePrimary()
+	case HasOne, HasMany:
+		key, err = t.singlePrimary()
+		relatedKey = r.ForeignKey
+	case ManyToMany:
+		key, err = t.singlePrimary()
+		if err == nil {
+			relatedKey, err = r.Table.singlePrimary()
+		}
+	default:
+		err = fmt.Errorf("table %s: unknown kind of relation %s", t.Name, r.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	keyField, err := t.columnField(key)
+	if err != nil {
+		return err
+	}
+	relatedField, err := r.Table.columnField(relatedKey)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]interface{}, 0, len(entities))
+	seen := make(map[string]bool, len(entities))
+	for _, e := range entities {
+		if k, v, ok := relationKey(e, keyField); ok && !seen[k] && !isZero(v) {
+			seen[k] = true
+			keys = append(keys, v)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// ManyToMany: related keys of each key, from the join table
+	var joins map[string][]string
+	if r.Kind == ManyToMany {
+		pairs := make([]map[string]interface{}, 0)
+		for _, ks := range chunks(keys, preloadBatch) {
+			jq := q.relatedQuery()
+			jq.Select(r.ForeignKey, r.JoinKey).From(r.JoinTable).Where(jq.In(r.ForeignKey, ks...))
+			d := make([]map[string]interface{}, 0)
+			if err := jq.Rows(&d); err != nil {
+				return err
+			}
+			pairs = append(pairs, d...)
+		}
+
+		joins = make(map[string][]string)
+		keys = make([]interface{}, 0, len(pairs))
+		seen = make(map[string]bool, len(pairs))
+		for _, p := range pairs {
+			k, rk := keyString(p[r.ForeignKey]), keyString(p[r.JoinKey])
+			joins[k] = append(joins[k], rk)
+			if !seen[rk] {
+				seen[rk] = true
+				keys = append(keys, p[r.JoinKey])
+			}
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+	}
+
+	rows := reflect.MakeSlice(reflect.SliceOf(r.Table.EntityType), 0, len(keys))
+	for _, ks := range chunks(keys, preloadBatch) {
+		rq := q.relatedQuery()
+		rq.Table = r.Table
+		rq.Select(r.Table.SelectFields...).From(r.Table.Name).Where(rq.In(relatedKey, ks...))
+		if c, ok := r.Table.softDelete(); ok {
+			rq.DefaultWhere(fmt.Sprintf("%s IS NULL", rq.quoteField(c.Name)))
+		}
+		d := reflect.New(rows.Type())
+		if err := rq.Rows(d.Interface()); err != nil {
+			return err
+		}
+		rows = reflect.AppendSlice(rows, d.Elem())
+	}
+
+	related := make([]reflect.Value, rows.Len())
+	byKey := make(map[string][]reflect.Value)
+	for i := range related {
+		related[i] = rows.Index(i)
+		if k, _, ok := relationKey(related[i], relatedField); ok {
+			byKey[k] = append(byKey[k], related[i])
+		}
+	}
+
+	// Nested relations are loaded before the related entities are copied
+	if len(nested) > 0 {
+		if err := q.loadRelations(r.Table, related, nested); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entities {
+		k, _, ok := relationKey(e, keyField)
+		if !ok {
+			continue
+		}
+
+		var vs []reflect.Value
+		if r.Kind == ManyToMany {
+			for _, rk := range joins[k] {
+				vs = append(vs, byKey[rk]...)
+			}
+		} else {
+			vs = byKey[k]
+		}
+		setRelated(fieldByIndex(e, field), vs)
+	}
+	return nil
+}
+
+// Keys split in chunks of at most n
+func chunks(keys []interface{}, n int) [][]interface{} {
+	cs := make([][]interface{}, 0, (len(keys)+n-1)/n)
+	for len(keys) > n {
+		cs = append(cs, keys[:n:n])
+		keys = keys[n:]
+	}
+	return append(cs, keys)
+}
+
+// Query in the transaction and context of q
+func (q *Query) relatedQuery() *Query {
+	c := NewQuery(q.Server)
+	c.Tx = q.Tx
+	c.ctx = q.ctx
+	return c
+}
+
+// Key of the field at index of e, as a string to match int64 with []byte or
+// string values of other drivers. NULL keys are not ok.
+func relationKey(e reflect.Value, index []int) (string, interface{}, bool) {
+	v, ok := fieldValue(e, index)
+	if !ok {
+		return "", nil, false
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil, false
+		}
+		v = v.Elem()
+	}
+	return keyString(v.Interface()), v.Interface(), true
+}
+
+// Key value as a string
+func keyString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// Set field, T, *T, []T or []*T, to related entities vs
+func setRelated(field reflect.Value, vs []reflect.Value) {
+	elem := func(typ reflect.Type, v reflect.Value) reflect.Value {
+		if typ.Kind() == reflect.Ptr {
+			p := reflect.New(v.Type())
+			p.Elem().Set(v)
+			return p
+		}
+		return v
+	}
+
+	if field.Kind() == reflect.Slice {
+		s := reflect.MakeSlice(field.Type(), 0, len(vs))
+		for _, v := range vs {
+			s = reflect.Append(s, elem(field.Type().Elem(), v))
+		}
+		field.Set(s)
+		return
+	}
+
+	if len(vs) == 0 {
+		field.Set(reflect.Zero(field.Type()))
+		return
+	}
+	field.Set(elem(field.Type(), vs[0]))
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+    "testing"
+    "time"
+)
+
+type relUser struct {
+    UserID   int64 `db:",pk,autoincr"`
+    Nickname string
+    Logins   []relLogin
+    Login    *relLogin
+    Roles    []*relRole
+}
+
+type relLogin struct {
+    LoginID      int64 `db:",pk,autoincr"`
+    UserID       int64
+    UserAgent    string
+    DeletionTime *time.Time `db:",softdelete"`
+    User         *relUser
+}
+
+type relRole struct {
+    RoleID int64 `db:",pk,autoincr"`
+    Name   string
+}
+
+func TestPreload(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    s := qt.Query.Server
+    sqls := []string{
+        `ALTER TABLE "passport_login" ADD COLUMN "DeletionTime" DATETIME NULL`,
+        `DROP TABLE IF EXISTS "passport_role"`,
+        `CREATE TABLE "passport_role" ("RoleID" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, "Name" TEXT NOT NULL)`,
+        `DROP TABLE IF EXISTS "passport_user_role"`,
+        `CREATE TABLE "passport_user_role" ("UserID" INTEGER NOT NULL, "RoleID" INTEGER NOT NULL)`,
+        `INSERT INTO "passport_user" ("UserID", "CreationTime", "BirthYear", "Gender", "Nickname") VALUES (1, '', 1980, 'Male', 'Bob'), (2, '', 1990, 'Female', 'Alice'), (3, '', 2000, 'Male', 'Carol')`,
+        `INSERT INTO "passport_login" ("UserID", "CreationTime", "LoginIp", "AnonymousID", "AuthCode", "UserAgent") VALUES (1, '', 0, '', '', 'curl'), (1, '', 0, '', '', 'wget'), (2, '', 0, '', '', 'lynx')`,
+        `INSERT INTO "passport_role" ("RoleID", "Name") VALUES (1, 'admin'), (2, 'editor')`,
+        `INSERT INTO "passport_user_role" ("UserID", "RoleID") VALUES (1, 1), (1, 2), (2, 2)`,
+    }
+    for _, v := range sqls {
+        if _, err := s.Exec(v); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+    Servers["passport"] = s
+    defer delete(Servers, "passport")
+
+    users := NewTable("passport_user", relUser{})
+    logins := NewTable("passport_login", relLogin{})
+    roles := NewTable("passport_role", relRole{})
+    users.HasMany("Logins", logins, "UserID").HasOne("Login", logins, "UserID").ManyToMany("Roles", roles, "passport_user_role", "UserID", "RoleID")
+    logins.BelongsTo("User", users, "UserID")
+    if len(users.SelectFields) != 2 {
+        t.Fatalf("SelectFields: %#v\n", users.SelectFields)
+    }
+
+    m := NewModel("passport", users)
+    d := []relUser{}
+    if err := m.Select().OrderAsc("UserID").Preload("Logins.User", "Roles", "Login").Rows(&d); err != nil {
+        t.Fatalf("Preload: %v\n", err)
+    }
+    if len(d) != 3 {
+        t.Fatalf("Preload: %#v\n", d)
+    }
+
+    // HasMany, nested BelongsTo
+    if len(d[0].Logins) != 2 || d[0].Logins[0].UserAgent != "curl" || d[0].Logins[1].UserAgent != "wget" || len(d[1].Logins) != 1 || len(d[2].Logins) != 0 {
+        t.Fatalf("HasMany: %#v\n", d)
+    }
+    if u := d[0].Logins[1].User; u == nil || u.Nickname != "Bob" || u.Logins != nil {
+        t.Fatalf("BelongsTo: %#v\n", u)
+    }
+
+    // HasOne
+    if d[1].Login == nil || d[1].Login.UserAgent != "lynx" || d[2].Login != nil {
+        t.Fatalf("HasOne: %#v\n", d[1].Login)
+    }
+
+    // ManyToMany
+    if len(d[0].Roles) != 2 || d[0].Roles[0].Name != "admin" || d[0].Roles[1].Name != "editor" || len(d[1].Roles) != 1 || d[1].Roles[0].Name != "editor" || len(d[2].Roles) != 0 {
+        t.Fatalf("ManyToMany: %#v\n", d)
+    }
+
+    // Row
+    l := relLogin{}
+    lm := NewModel("passport", logins)
+    if err := lm.Select().Preload("User.Roles").Row(&l, Where{"UserAgent": "lynx"}); err != nil {
+        t.Fatalf("Row: %v\n", err)
+    }
+    if l.User == nil || l.User.Nickname != "Alice" || len(l.User.Roles) != 1 {
+        t.Fatalf("Row: %#v\n", l)
+    }
+
+    // Count ignores relations
+    if n, err := m.Select().Preload("Logins").Count(); err != nil || n != 3 {
+        t.Fatalf("Count: %d %v\n", n, err)
+    }
+
+    if err := m.Select().Preload("Friends").Rows(&d); err == nil {
+        t.Fatalf("Preload: unknown relation\n")
+    }
+
+    // Soft deleted rows are not loaded
+    w := relLogin{}
+    if err := lm.Select().Row(&w, Where{"UserAgent": "wget"}); err != nil {
+        t.Fatalf("Row: %v\n", err)
+    }
+    if err := lm.Remove(&w); err != nil {
+        t.Fatalf("Remove: %v\n", err)
+    }
+    d = []relUser{}
+    if err := m.Select().OrderAsc("UserID").Preload("Logins").Rows(&d); err != nil || len(d) != 3 {
+        t.Fatalf("Preload: %v %v\n", d, err)
+    }
+    if len(d[0].Logins) != 1 || d[0].Logins[0].UserAgent != "curl" {
+        t.Fatalf("Preload: soft deleted: %#v\n", d[0].Logins)
+    }
+
+    // More keys than fit in one IN list
+    defer func(n int) { preloadBatch = n }(preloadBatch)
+    preloadBatch = 1
+    d = []relUser{}
+    if err := m.Select().OrderAsc("UserID").Preload("Logins", "Roles").Rows(&d); err != nil || len(d) != 3 {
+        t.Fatalf("Preload: batch: %v %v\n", d, err)
+    }
+    if len(d[0].Logins) != 1 || len(d[1].Logins) != 1 || len(d[0].Roles) != 2 || len(d[1].Roles) != 1 || d[1].Roles[0].Name != "editor" {
+        t.Fatalf("Preload: batch: %#v\n", d)
+    }
+
+    // No row, nothing is loaded
+    l = relLogin{}
+    if err := lm.Select().Preload("User").Row(&l, Where{"UserAgent": "mosaic"}); err != nil || l.User != nil || l.LoginID != 0 {
+        t.Fatalf("Row: no row: %#v %v\n", l, err)
+    }
+
+    // Zero keys are not looked up
+    z := []relUser{{Nickname: "new"}}
+    if err := m.Select().Preload("Logins").preload(&z); err != nil || z[0].Logins != nil {
+        t.Fatalf("Preload: zero key: %#v %v\n", z, err)
+    }
+}
@@ -0,0 +1,232 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Typed repository of entity T, a struct mapped by NewTable.
+// The primary key field is tagged pk:"true".
+//
+//	users := db.NewRepo[User](s, "passport_user")
+//	u, err := users.Find(ctx, 1000000)
+type Repo[T any] struct {
+	// Server
+	Server *Server
+
+	// Table of T
+	Table *Table
+}
+
+// Entity by primary key, sql.ErrNoRows if not found.
+// Values of a composite key are given in key order.
+func (r *Repo[T]) Find(ctx context.Context, id ...interface{}) (T, error) {
+	w, err := r.Table.keyWhere(id)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	q := r.Query()
+	q.mapToWhere(w)
+	return q.First(ctx)
+}
+
+// Entities matching cond, all if cond is empty
+func (r *Repo[T]) FindAll(ctx context.Context, cond Where) ([]T, error) {
+	q := r.Query()
+	if len(cond) > 0 {
+		q.mapToWhere(cond)
+	}
+	return q.Find(ctx)
+}
+
+// First entity matching cond in primary key order, sql.ErrNoRows if none
+func (r *Repo[T]) First(ctx context.Context, cond Where) (T, error) {
+	q := r.Query()
+	if len(cond) > 0 {
+		q.mapToWhere(cond)
+	}
+	if ps := r.Table.primaries(); len(ps) > 0 {
+		q.OrderAsc(ps...)
+	}
+	return q.First(ctx)
+}
+
+// Insert entity, generated keys are written back to zero primary key fields
+func (r *Repo[T]) Insert(ctx context.Context, entity *T) error {
+	d, err := r.Table.insertItem(entity)
+	if err != nil {
+		return err
+	}
+
+	q := r.Server.InsertInto(r.Table.Name).WithContext(ctx)
+	q.SetPrimary(r.Table.primaries()...) // PostgreSQL compatibility
+	res, err := q.Exec(d)
+	if err != nil {
+		return err
+	}
+
+	r.Table.setKeys(entity, res.Keys)
+	return nil
+}
+
+// Update entity by primary key, nothing is executed if no column is updated
+func (r *Repo[T]) Update(ctx context.Context, entity *T) error {
+	w, _, err := r.Table.primaryWhere(entity)
+	if err != nil {
+		return err
+	}
+	d, err := r.Table.updateItem(entity)
+	if err != nil || len(d) == 0 {
+		return err
+	}
+
+	q := r.Server.Update(r.Table.Name).WithContext(ctx)
+	_, err = q.Exec(d, w)
+	return err
+}
+
+// Delete entity by primary key, values of a composite key in key order
+func (r *Repo[T]) Delete(ctx context.Context, id ...interface{}) error {
+	w, err := r.Table.keyWhere(id)
+	if err != nil {
+		return err
+	}
+
+	q := r.Server.DeleteFrom(r.Table.Name).WithContext(ctx)
+	_, err = q.Exec(w)
+	return err
+}
+
+// Typed select query of all fields
+func (r *Repo[T]) Query() *TypedQuery[T] {
+	q := r.Server.Select(r.Table.SelectFields...).From(r.Table.Name)
+	q.Table = r.Table
+	return &TypedQuery[T]{q}
+}
+
+// New repository of T on table
+func NewRepo[T any](server *Server, table string) *Repo[T] {
+	var entity T
+	return &Repo[T]{Server: server, Table: NewTable(table, entity)}
+}
+
+// Select query returning T.
+// Conditions like Eq and And come from Query, chained methods keep the type.
+//
+//	q := users.Query()
+//	list, err := q.Where(q.Eq("Gender", "Male")).OrderDesc("UserID").Limit(0, 10).Find(ctx)
+type TypedQuery[T any] struct {
+	*Query
+}
+
+// Where
+func (q *TypedQuery[T]) Where(qs ...string) *TypedQuery[T] {
+	q.Query.Where(qs...)
+	return q
+}
+
+// Group by
+func (q *TypedQuery[T]) GroupBy(f ...string) *TypedQuery[T] {
+	q.Query.GroupBy(f...)
+	return q
+}
+
+// Having
+func (q *TypedQuery[T]) Having(qs ...string) *TypedQuery[T] {
+	q.Query.Having(qs...)
+	return q
+}
+
+// Order by asc
+func (q *TypedQuery[T]) OrderAsc(f ...string) *TypedQuery[T] {
+	q.Query.OrderAsc(f...)
+	return q
+}
+
+// Order by desc
+func (q *TypedQuery[T]) OrderDesc(f ...string) *TypedQuery[T] {
+	q.Query.OrderDesc(f...)
+	return q
+}
+
+// Order by terms like "Gender DESC"
+func (q *TypedQuery[T]) OrderBy(terms ...string) *TypedQuery[T] {
+	q.Query.OrderBy(terms...)
+	return q
+}
+
+// NULLS FIRST for the last order terms
+func (q *TypedQuery[T]) NullsFirst() *TypedQuery[T] {
+	q.Query.NullsFirst()
+	return q
+}
+
+// NULLS LAST for the last order terms
+func (q *TypedQuery[T]) NullsLast() *TypedQuery[T] {
+	q.Query.NullsLast()
+	return q
+}
+
+// Limit
+func (q *TypedQuery[T]) Limit(offset, rows int64) *TypedQuery[T] {
+	q.Query.Limit(offset, rows)
+	return q
+}
+
+// FOR UPDATE
+func (q *TypedQuery[T]) ForUpdate() *TypedQuery[T] {
+	q.Query.ForUpdate()
+	return q
+}
+
+// FOR SHARE
+func (q *TypedQuery[T]) ForShare() *TypedQuery[T] {
+	q.Query.ForShare()
+	return q
+}
+
+// Preload relations
+func (q *TypedQuery[T]) Preload(names ...string) *TypedQuery[T] {
+	q.Query.Preload(names...)
+	return q
+}
+
+// All rows
+func (q *TypedQuery[T]) Find(ctx context.Context) ([]T, error) {
+	d := make([]T, 0)
+	err := q.Query.WithContext(ctx).Rows(&d)
+	return d, err
+}
+
+// First row, sql.ErrNoRows if none
+func (q *TypedQuery[T]) First(ctx context.Context) (T, error) {
+	d := make([]T, 0, 1)
+	err := q.Query.WithContext(ctx).Limit(0, 1).Rows(&d)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if len(d) == 0 {
+		var zero T
+		return zero, sql.ErrNoRows
+	}
+	return d[0], nil
+}
+
+// Call fn with each row, stop at the first error
+func (q *TypedQuery[T]) Each(ctx context.Context, fn func(T) error) error {
+	return q.Query.WithContext(ctx).Each(fn)
+}
+
+// Number of rows
+func (q *TypedQuery[T]) Count(ctx context.Context) (int64, error) {
+	return q.Query.WithContext(ctx).Count()
+}
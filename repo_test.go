@@ -0,0 +1,96 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+
+package db
+
+import (
+    "context"
+    "database/sql"
+    "testing"
+)
+
+type repoUser struct {
+    UserID       int64 `pk:"true"`
+    CreationTime string
+    BirthYear    int64
+    Gender       string
+    Nickname     string
+}
+
+func TestRepo(t *testing.T) {
+    qt := NewQueryTest("sqlite3", "sqlite3.db")
+    qt.Init(t)
+    ctx := context.Background()
+    users := NewRepo[repoUser](qt.Query.Server, "passport_user")
+
+    // Insert writes back the id
+    u := repoUser{CreationTime: "2015-01-17 00:00:00", BirthYear: 1980, Gender: "Male", Nickname: "Bob"}
+    if err := users.Insert(ctx, &u); err != nil || u.UserID != 1000000 {
+        t.Fatalf("Insert: %d %v\n", u.UserID, err)
+    }
+    a := repoUser{UserID: 2000000, CreationTime: "2015-01-17 01:00:00", BirthYear: 1986, Gender: "Female", Nickname: "Alice"}
+    if err := users.Insert(ctx, &a); err != nil || a.UserID != 2000000 {
+        t.Fatalf("Insert: %d %v\n", a.UserID, err)
+    }
+
+    // Find, First, FindAll
+    r, err := users.Find(ctx, 1000000)
+    if err != nil || r != u {
+        t.Fatalf("Find: %v %v\n", r, err)
+    }
+    if _, err := users.Find(ctx, 1); err != sql.ErrNoRows {
+        t.Fatalf("Find: %v\n", err)
+    }
+    r, err = users.First(ctx, Where{"Gender": "Female"})
+    if err != nil || r.Nickname != "Alice" {
+        t.Fatalf("First: %v %v\n", r, err)
+    }
+    all, err := users.FindAll(ctx, nil)
+    if err != nil || len(all) != 2 {
+        t.Fatalf("FindAll: %v %v\n", all, err)
+    }
+
+    // Update
+    u.Nickname = "Bobby"
+    if err := users.Update(ctx, &u); err != nil {
+        t.Fatalf("Update: %v\n", err)
+    }
+
+    // Typed query
+    q := users.Query()
+    list, err := q.Where(q.Ge("BirthYear", 1980)).OrderDesc("BirthYear").Limit(0, 10).Find(ctx)
+    if err != nil || len(list) != 2 || list[0].Nickname != "Alice" || list[1].Nickname != "Bobby" {
+        t.Fatalf("Query: %v %v\n", list, err)
+    }
+    n, err := users.Query().Count(ctx)
+    if err != nil || n != 2 {
+        t.Fatalf("Count: %d %v\n", n, err)
+    }
+    names := []string{}
+    err = users.Query().OrderAsc("BirthYear").Each(ctx, func(u repoUser) error {
+        names = append(names, u.Nickname)
+        return nil
+    })
+    if err != nil || len(names) != 2 || names[0] != "Bobby" {
+        t.Fatalf("Each: %v %v\n", names, err)
+    }
+
+    // Delete
+    if err := users.Delete(ctx, 1000000); err != nil {
+        t.Fatalf("Delete: %v\n", err)
+    }
+    all, err = users.FindAll(ctx, Where{"UserID": 1000000})
+    if err != nil || len(all) != 0 {
+        t.Fatalf("Delete: %v %v\n", all, err)
+    }
+
+    // Canceled context
+    cctx, cancel := context.WithCancel(ctx)
+    cancel()
+    if _, err := users.Find(cctx, 2000000); err != context.Canceled {
+        t.Fatalf("Find: %v\n", err)
+    }
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// No result set left in Results
+var ErrNoResultSet = errors.New("no more result sets")
+
+// Result sets of a query or stored procedure, read one after another.
+//
+//	r, err := s.Call("monthly_report", 2015)
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	err = r.Rows(&totals)  // first result set
+//	err = r.Rows(&details) // second result set
+type Results struct {
+	// Server
+	server *Server
+
+	// Result rows
+	rows *sql.Rows
+
+	// Current result set has been read
+	read bool
+}
+
+// Scan the first row of the next result set into ptr
+func (r *Results) Row(ptr interface{}) error {
+	return r.scan(ptr, false)
+}
+
+// Scan all rows of the next result set into ptr, a pointer to a slice
+func (r *Results) Rows(ptr interface{}) error {
+	return r.scan(ptr, true)
+}
+
+// Skip the next result set
+func (r *Results) Skip() error {
+	return r.next()
+}
+
+// Close rows, safe to call more than once
+func (r *Results) Close() error {
+	if r.rows == nil {
+		return nil
+	}
+
+	err := r.rows.Close()
+	r.rows = nil
+	return err
+}
+
+// Scan the next result set
+func (r *Results) scan(ptr interface{}, isRows bool) error {
+	if err := r.next(); err != nil {
+		return err
+	}
+
+	columns, types, err := columnTypes(r.rows)
+	if err != nil {
+		return err
+	}
+
+	return r.server.scanRows(r.rows, columns, types, ptr, isRows)
+}
+
+// Advance to the next result set, the first one is current after the query
+func (r *Results) next() error {
+	if r.rows == nil {
+		return errors.New("results are closed")
+	}
+
+	if !r.read {
+		r.read = true
+		return nil
+	}
+
+	if !r.rows.NextResultSet() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return ErrNoResultSet
+	}
+	return nil
+}
+
+// Run a query returning several result sets
+func (e *Server) Results(sql string, args ...interface{}) (*Results, error) {
+	p, err := e.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.results(context.Background(), p, sql, args)
+}
+
+// Call a stored procedure: CALL proc(...) on MySQL, SELECT * FROM proc(...)
+// on PostgreSQL, where procedures do not return rows but set returning functions do.
+func (e *Server) Call(proc string, args ...interface{}) (*Results, error) {
+	str, err := e.callSQL(proc, len(args))
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Results(str, args...)
+}
+
+// New results
+func (e *Server) results(ctx context.Context, p queryer, sql string, args []interface{}) (*Results, error) {
+	sql, args, err := e.bindNamed(sql, args)
+	if err != nil {
+		return nil, err
+	}
+
+	sql, args, err = e.parseSQL(sql, args)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := p.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Results{server: e, rows: rows}, nil
+}
+
+// SQL to call proc with n arguments
+func (e *Server) callSQL(proc string, n int) (string, error) {
+	q := NewQuery(e)
+	name := q.quoteField(proc)
+	if q.err != nil {
+		return "", q.err
+	}
+
+	ph := make([]string, n)
+	for i := range ph {
+		ph[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	switch e.Type {
+	case "mysql":
+		return fmt.Sprintf("CALL %s(%s)", name, strings.Join(ph, ", ")), nil
+	case "postgres":
+		return fmt.Sprintf("SELECT * FROM %s(%s)", name, strings.Join(ph, ", ")), nil
+	}
+	return "", fmt.Errorf("stored procedures are not supported by %s", e.Type)
+}
@@ -5,7 +5,10 @@
 package db
 
 import (
+    "context"
     "database/sql"
+    "errors"
+    "fmt"
     _ "github.com/zhgo/mysql"
     _ "github.com/zhgo/postgresql"
     _ "github.com/zhgo/sqlite/sqlite3"
@@ -23,84 +26,155 @@ type Server struct {
 
     // Data Source Name
     DSN string `json:"dsn"`
+
+    // Skip result columns without a matching struct field instead of failing
+    IgnoreUnknownColumns bool `json:"ignoreUnknownColumns"`
+
+    // Fail on NULL into a struct field that can not hold it (string, int ...),
+    // instead of leaving the zero value. Pointer and sql.Null* fields always take NULL.
+    StrictNull bool `json:"strictNull"`
 }
 
 // Execute query, only return sql.Result
 func (e *Server) Exec(sql string, args ...interface{}) (sql.Result, error) {
-    sql, args = e.parseSQL(sql, args)
-    stmt, err := e.prepare(sql)
-    if err != nil {
-        return nil, err
-    }
-
-    defer stmt.Close()
+    return e.ExecContext(context.Background(), sql, args...)
+}
 
-    result, err := stmt.Exec(args...)
+// Execute query with context, only return sql.Result
+func (e *Server) ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+    p, err := e.conn()
     if err != nil {
         return nil, err
     }
 
-    return result, nil
+    return e.exec(ctx, p, sql, args)
 }
 
 // Get row.
 func (e *Server) Row(ptr interface{}, sql string, args ...interface{}) error {
-    rows, columns, err := e.rows(sql, args)
+    return e.RowContext(context.Background(), ptr, sql, args...)
+}
+
+// Get row with context
+func (e *Server) RowContext(ctx context.Context, ptr interface{}, sql string, args ...interface{}) error {
+    p, err := e.conn()
     if err != nil {
         log.Printf("%s\n", err)
         return err
     }
 
-    defer rows.Close()
+    return e.row(ctx, p, ptr, sql, args)
+}
 
-    columnsLen := len(columns)
+// Get all rows
+func (e *Server) Rows(ptr interface{}, sql string, args ...interface{}) error {
+    return e.RowsContext(context.Background(), ptr, sql, args...)
+}
 
-    kind, ptrRow, scan, err := scanVariables(ptr, columnsLen, false)
+// Get all rows with context
+func (e *Server) RowsContext(ctx context.Context, ptr interface{}, sql string, args ...interface{}) error {
+    p, err := e.conn()
     if err != nil {
         log.Printf("%s\n", err)
         return err
     }
 
-    // Return data
-    val := reflect.ValueOf(ptr).Elem()
+    return e.allRows(ctx, p, ptr, sql, args)
+}
 
-    if rows.Next() {
-        if err := rows.Scan(scan...); err != nil {
-            log.Printf("%s\n", err)
-            return err
-        }
+// Iterate rows, call Close if the iteration stops early
+func (e *Server) Iter(sql string, args ...interface{}) (*Iter, error) {
+    return e.IterContext(context.Background(), sql, args...)
+}
+
+// Iterate rows with context
+func (e *Server) IterContext(ctx context.Context, sql string, args ...interface{}) (*Iter, error) {
+    p, err := e.conn()
+    if err != nil {
+        return nil, err
+    }
 
-        switch kind {
-        case reflect.Struct: // struct
-            val.Set(reflect.ValueOf(ptrRow).Elem())
+    return e.iter(ctx, p, sql, args)
+}
 
-        case reflect.Map: //map
-            row := make(map[string]interface{}, columnsLen)
-            for i := 0; i < columnsLen; i++ {
-                row[columns[i]] = typeAssertion(*(scan[i].(*interface{})))
-            }
-            val.Set(reflect.ValueOf(row))
+// Begin a transaction
+func (e *Server) Begin() (*Tx, error) {
+    return e.BeginTx(context.Background(), nil)
+}
 
-        case reflect.Slice: //slice
-            row := make([]interface{}, columnsLen)
-            for i := 0; i < columnsLen; i++ {
-                row[i] = typeAssertion(*(scan[i].(*interface{})))
-            }
-            val.Set(reflect.ValueOf(row))
+// Begin a transaction with context and options
+func (e *Server) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+    if err := e.connect(); err != nil {
+        return nil, err
+    }
+
+    tx, err := dbObjects[e.DSN].BeginTx(ctx, opts)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Tx{Server: e, tx: tx}, nil
+}
+
+// Run fn in a transaction, commit if fn returns nil, otherwise rollback.
+func (e *Server) Transaction(fn func(tx *Tx) error) (err error) {
+    tx, err := e.Begin()
+    if err != nil {
+        return err
+    }
+
+    defer func() {
+        if r := recover(); r != nil {
+            tx.Rollback()
+            panic(r)
+        }
+    }()
+
+    if err = fn(tx); err != nil {
+        if rbErr := tx.Rollback(); rbErr != nil {
+            log.Printf("%s\n", rbErr)
         }
+        return err
     }
 
-    if err = rows.Err(); err != nil {
+    return tx.Commit()
+}
+
+// Execute query, only return sql.Result
+func (e *Server) exec(ctx context.Context, p queryer, sql string, args []interface{}) (sql.Result, error) {
+    sql, args, err := e.bindNamed(sql, args)
+    if err != nil {
+        return nil, err
+    }
+
+    sql, args, err = e.parseSQL(sql, args)
+    if err != nil {
+        return nil, err
+    }
+    result, err := p.ExecContext(ctx, sql, args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return result, nil
+}
+
+// Get row.
+func (e *Server) row(ctx context.Context, p queryer, ptr interface{}, sql string, args []interface{}) error {
+    rows, columns, types, err := e.rows(ctx, p, sql, args)
+    if err != nil {
         log.Printf("%s\n", err)
         return err
     }
 
-    return nil
+    defer rows.Close()
+
+    return e.scanRows(rows, columns, types, ptr, false)
 }
 
 // Get all rows
-func (e *Server) Rows(ptr interface{}, sql string, args ...interface{}) error {
-    rows, columns, err := e.rows(sql, args)
+func (e *Server) allRows(ctx context.Context, p queryer, ptr interface{}, sql string, args []interface{}) error {
+    rows, columns, types, err := e.rows(ctx, p, sql, args)
     if err != nil {
         log.Printf("%s\n", err)
         return err
@@ -108,9 +182,12 @@ func (e *Server) Rows(ptr interface{}, sql string, args ...interface{}) error {
 
     defer rows.Close()
 
-    columnsLen := len(columns)
+    return e.scanRows(rows, columns, types, ptr, true)
+}
 
-    kind, ptrRow, scan, err := scanVariables(ptr, columnsLen, true)
+// Scan the first row (isRows false) or all rows of the current result set into ptr
+func (e *Server) scanRows(rows *sql.Rows, columns []string, types []string, ptr interface{}, isRows bool) error {
+    s, err := newRowScanner(ptr, columns, types, isRows, e.IgnoreUnknownColumns, e.StrictNull)
     if err != nil {
         log.Printf("%s\n", err)
         return err
@@ -120,29 +197,22 @@ func (e *Server) Rows(ptr interface{}, sql string, args ...interface{}) error {
     val := reflect.ValueOf(ptr).Elem()
 
     for rows.Next() {
-        if err := rows.Scan(scan...); err != nil {
+        if err := rows.Scan(s.targets()...); err != nil {
             log.Printf("%s\n", err)
             return err
         }
 
-        switch kind {
-        case reflect.Struct: // struct
-            val.Set(reflect.Append(val, reflect.ValueOf(ptrRow).Elem()))
-
-        case reflect.Map: // map
-            row := make(map[string]interface{}, columnsLen)
-            for i := 0; i < columnsLen; i++ {
-                row[columns[i]] = typeAssertion(*(scan[i].(*interface{})))
-            }
-            val.Set(reflect.Append(val, reflect.ValueOf(row)))
+        v, err := s.value()
+        if err != nil {
+            log.Printf("%s\n", err)
+            return err
+        }
 
-        case reflect.Slice: // slice
-            row := make([]interface{}, columnsLen)
-            for i := 0; i < columnsLen; i++ {
-                row[i] = typeAssertion(*(scan[i].(*interface{})))
-            }
-            val.Set(reflect.Append(val, reflect.ValueOf(row)))
+        if !isRows {
+            val.Set(v)
+            break
         }
+        val.Set(reflect.Append(val, v))
     }
 
     if err = rows.Err(); err != nil {
@@ -185,41 +255,58 @@ func (e *Server) Close() {
     }
 }
 
-// Execute query, return sql.Rows, rows.Columns
-func (e *Server) rows(sql string, args []interface{}) (*sql.Rows, []string, error) {
-    sql, args = e.parseSQL(sql, args)
-    stmt, err := e.prepare(sql)
+// Execute query, return sql.Rows, rows.Columns and database type names of columns
+func (e *Server) rows(ctx context.Context, p queryer, sql string, args []interface{}) (*sql.Rows, []string, []string, error) {
+    sql, args, err := e.bindNamed(sql, args)
     if err != nil {
-        return nil, nil, err
+        return nil, nil, nil, err
     }
 
-    defer stmt.Close()
+    sql, args, err = e.parseSQL(sql, args)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    rows, err := p.QueryContext(ctx, sql, args...)
+    if err != nil {
+        return nil, nil, nil, err
+    }
 
-    rows, err := stmt.Query(args...)
+    columns, types, err := columnTypes(rows)
     if err != nil {
-        return nil, nil, err
+        rows.Close()
+        return nil, nil, nil, err
     }
 
+    return rows, columns, types, nil
+}
+
+// Columns and database type names of columns of the current result set
+func columnTypes(rows *sql.Rows) ([]string, []string, error) {
     columns, err := rows.Columns()
     if err != nil {
         return nil, nil, err
     }
 
-    return rows, columns, nil
-}
+    cts, err := rows.ColumnTypes()
+    if err != nil {
+        return nil, nil, err
+    }
 
-// Prepare SQL
-func (e *Server) prepare(sql string) (*sql.Stmt, error) {
-    if err := e.connect(); err != nil {
-        return nil, err
+    types := make([]string, len(cts))
+    for i, ct := range cts {
+        types[i] = ct.DatabaseTypeName()
     }
 
-    stmt, err := dbObjects[e.DSN].Prepare(sql)
-    if err != nil {
+    return columns, types, nil
+}
+
+// Connection pool
+func (e *Server) conn() (queryer, error) {
+    if err := e.connect(); err != nil {
         return nil, err
     }
 
-    return stmt, nil
+    return dbObjects[e.DSN], nil
 }
 
 // Connect to database
@@ -238,37 +325,271 @@ func (e *Server) connect() error {
 }
 
 // sql compatibility
-func (e *Server) parseSQL(str string, args []interface{}) (string, []interface{}) {
+func (e *Server) parseSQL(str string, args []interface{}) (string, []interface{}, error) {
     switch e.Type {
     case "postgres":
-        return str, args
+        return str, args, nil
     case "mysql":
         str = e.parseQuotes(str)
         return e.parseParameters(str, args)
     case "sqlite3":
         return e.parseParameters(str, args)
     }
-    return str, args
+    return str, args, nil
+}
+
+// SQL token kinds
+const (
+    tokenText = iota
+    tokenString
+    tokenIdentifier
+)
+
+// SQL token
+type sqlToken struct {
+    kind int
+
+    // Raw text, including quotes
+    str string
+}
+
+// Split SQL into plain text, string literals and quoted identifiers
+func (e *Server) tokenize(str string) []sqlToken {
+    tokens := make([]sqlToken, 0)
+    start := 0
+    for i := 0; i < len(str); i++ {
+        c := str[i]
+        if c != '\'' && c != '"' && c != '`' {
+            continue
+        }
+
+        if i > start {
+            tokens = append(tokens, sqlToken{tokenText, str[start:i]})
+        }
+
+        // Find closing quote, doubled quote is an escaped quote
+        j := i + 1
+        for ; j < len(str); j++ {
+            if c == '\'' && str[j] == '\\' && e.Type == "mysql" {
+                j++
+                continue
+            }
+            if str[j] == c {
+                if j+1 < len(str) && str[j+1] == c {
+                    j++
+                    continue
+                }
+                break
+            }
+        }
+        if j >= len(str) {
+            j = len(str) - 1
+        }
+
+        kind := tokenIdentifier
+        if c == '\'' {
+            kind = tokenString
+        }
+        tokens = append(tokens, sqlToken{kind, str[i : j+1]})
+        i = j
+        start = j + 1
+    }
+
+    if start < len(str) {
+        tokens = append(tokens, sqlToken{tokenText, str[start:]})
+    }
+    return tokens
 }
 
-// " to `
+// "ident" to `ident`, embedded "" to " and ` to ``
 func (e *Server) parseQuotes(str string) string {
-    return strings.Replace(str, `"`, "`", -1)
+    tokens := e.tokenize(str)
+    for i, t := range tokens {
+        if t.kind != tokenIdentifier || t.str[0] != '"' || len(t.str) < 2 || t.str[len(t.str)-1] != '"' {
+            continue
+        }
+        name := strings.Replace(t.str[1:len(t.str)-1], `""`, `"`, -1)
+        tokens[i].str = "`" + strings.Replace(name, "`", "``", -1) + "`"
+    }
+    return joinTokens(tokens)
 }
 
-// $1, $2, $3 to ?, ?, ?
-func (e *Server) parseParameters(str string, args []interface{}) (string, []interface{}) {
+// $1, $2, $3 to ?, ?, ?, string literals and quoted identifiers are left as is.
+// A $n without argument n is an error.
+func (e *Server) parseParameters(str string, args []interface{}) (string, []interface{}, error) {
     re := regexp.MustCompile(`\$(\d+)`)
-    sli := re.FindAllStringSubmatch(str, -1)
-    newArgs := make([]interface{}, len(sli))
-    for i, v := range sli {
-        vi, err := strconv.ParseInt(v[1], 10, 0)
-        if err != nil {
-            log.Printf("%s\n", err)
+    newArgs := make([]interface{}, 0)
+    tokens := e.tokenize(str)
+    for i, t := range tokens {
+        if t.kind != tokenText {
+            continue
+        }
+        for _, v := range re.FindAllStringSubmatch(t.str, -1) {
+            vi, err := strconv.ParseInt(v[1], 10, 0)
+            if err != nil || vi < 1 || int(vi) > len(args) {
+                return str, args, fmt.Errorf("parameter $%s has no argument, %d given", v[1], len(args))
+            }
+            newArgs = append(newArgs, args[vi-1])
         }
-        newArgs[i] = args[vi-1]
+        tokens[i].str = re.ReplaceAllString(t.str, "?")
+    }
+    return joinTokens(tokens), newArgs, nil
+}
+
+// :name and @name to $1, $2 ..., bound from sql.Named arguments, or from a
+// single Item, map or struct argument if SQL has named parameters. A name used
+// more than once gets the same $n. Otherwise SQL is left as is.
+func (e *Server) bindNamed(str string, args []interface{}) (string, []interface{}, error) {
+    tokens := e.tokenize(str)
+    named, err := namedArgs(args, hasNamed(tokens))
+    if err != nil || named == nil {
+        return str, args, err
+    }
+
+    newArgs := make([]interface{}, 0)
+    index := make(map[string]int)
+    for i, t := range tokens {
+        if t.kind != tokenText {
+            continue
+        }
+
+        s := t.str
+        out := make([]byte, 0, len(s))
+        for j := 0; j < len(s); j++ {
+            c := s[j]
+            k := namedParam(s, j)
+            if k == 0 {
+                out = append(out, c)
+                continue
+            }
+
+            name := s[j+1 : k]
+            n, ok := index[name]
+            if !ok {
+                v, ok := named.lookup(name)
+                if !ok {
+                    return str, args, fmt.Errorf("named parameter %s%s has no value", string(c), name)
+                }
+                newArgs = append(newArgs, v)
+                n = len(newArgs)
+                index[name] = n
+            }
+            out = append(out, fmt.Sprintf("$%d", n)...)
+            j = k - 1
+        }
+        tokens[i].str = string(out)
+    }
+    return joinTokens(tokens), newArgs, nil
+}
+
+// End of the :name or @name parameter at s[j], 0 if there is none.
+// Name starts with a letter or _, "::" casts and "@@" variables are skipped.
+func namedParam(s string, j int) int {
+    c := s[j]
+    if (c != ':' && c != '@') || (j > 0 && (s[j-1] == ':' || s[j-1] == '@' || isNameByte(s[j-1]))) {
+        return 0
+    }
+
+    k := j + 1
+    for k < len(s) && isNameByte(s[k]) {
+        k++
+    }
+    if k == j+1 || (s[j+1] >= '0' && s[j+1] <= '9') {
+        return 0
+    }
+    return k
+}
+
+// Whether text tokens have a named parameter
+func hasNamed(tokens []sqlToken) bool {
+    for _, t := range tokens {
+        if t.kind != tokenText {
+            continue
+        }
+        for j := 0; j < len(t.str); j++ {
+            if namedParam(t.str, j) > 0 {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Values of named parameters
+type namedValues map[string]interface{}
+
+// Value of name, exact match first, then case-insensitive
+func (n namedValues) lookup(name string) (interface{}, bool) {
+    if v, ok := n[name]; ok {
+        return v, true
+    }
+    for k, v := range n {
+        if strings.EqualFold(k, name) {
+            return v, true
+        }
+    }
+    return nil, false
+}
+
+// Named values of args, nil if args are positional. A single map or struct
+// argument is named only if SQL has named parameters and it is no driver.Valuer.
+func namedArgs(args []interface{}, params bool) (namedValues, error) {
+    if len(args) == 0 {
+        return nil, nil
+    }
+
+    if _, ok := args[0].(sql.NamedArg); ok {
+        named := make(namedValues)
+        for _, v := range args {
+            a, ok := v.(sql.NamedArg)
+            if !ok {
+                return nil, errors.New("sql.Named arguments can not be mixed with positional ones")
+            }
+            named[a.Name] = a.Value
+        }
+        return named, nil
+    }
+
+    if !params || len(args) != 1 || args[0] == nil {
+        return nil, nil
+    }
+
+    t := reflect.TypeOf(args[0])
+    if t.Implements(valuerType) {
+        return nil, nil
+    }
+    if t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    if t.Implements(valuerType) || reflect.PtrTo(t).Implements(valuerType) {
+        return nil, nil
+    }
+    if t.Kind() != reflect.Map && (t.Kind() != reflect.Struct || isValueType(t)) {
+        return nil, nil
+    }
+    if t.Kind() == reflect.Map && t.Key().Kind() != reflect.String {
+        return nil, nil
+    }
+
+    item, err := toItem(args[0])
+    if err != nil {
+        return nil, err
+    }
+    return namedValues(item), nil
+}
+
+// Letter, digit or _
+func isNameByte(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Join tokens to SQL
+func joinTokens(tokens []sqlToken) string {
+    str := ""
+    for _, t := range tokens {
+        str += t.str
     }
-    return re.ReplaceAllString(str, "?"), newArgs
+    return str
 }
 
 // New Server
@@ -5,10 +5,14 @@
 package db
 
 import (
+    "database/sql"
+    "database/sql/driver"
+    "encoding/json"
     "fmt"
     "io/ioutil"
     "strings"
     "testing"
+    "time"
 )
 
 /*
@@ -92,10 +96,10 @@ func (st *ServerTest) Insert(t *testing.T) {
     if err != nil {
         t.Fatalf("[%s]: %v\n", st.Server.Type, err)
     }
-    st.dataValidation(t, string(d["CreationTime"].([]byte)), "2015-01-17 00:00:00")
+    st.dataValidation(t, d["CreationTime"], "2015-01-17 00:00:00")
     st.dataValidation(t, d["BirthYear"], int64(1980))
-    st.dataValidation(t, string(d["Gender"].([]byte)), "Male")
-    st.dataValidation(t, string(d["Nickname"].([]byte)), "肯·汤普逊")
+    st.dataValidation(t, d["Gender"], "Male")
+    st.dataValidation(t, d["Nickname"], "肯·汤普逊")
 }
 
 func (st *ServerTest) Update(t *testing.T) {
@@ -120,10 +124,10 @@ func (st *ServerTest) Update(t *testing.T) {
     if err != nil {
         t.Fatalf("[%s]: %v\n", st.Server.Type, err)
     }
-    st.dataValidation(t, string(d["CreationTime"].([]byte)), "2015-01-17 00:00:00")
+    st.dataValidation(t, d["CreationTime"], "2015-01-17 00:00:00")
     st.dataValidation(t, d["BirthYear"], int64(1982))
-    st.dataValidation(t, string(d["Gender"].([]byte)), "Female")
-    st.dataValidation(t, string(d["Nickname"].([]byte)), "Bob")
+    st.dataValidation(t, d["Gender"], "Female")
+    st.dataValidation(t, d["Nickname"], "Bob")
 }
 
 func (st *ServerTest) Delete(t *testing.T) {
@@ -152,13 +156,17 @@ func (st *ServerTest) Rows(t *testing.T) {
     if len(d) != 1 {
         t.Fatalf("[%s] Returns the number of rows of data is incorrect: %v\n", st.Server.Type, len(d))
     }
-    st.dataValidation(t, string(d[0]["CreationTime"].([]byte)), "2015-01-17 00:00:00")
+    st.dataValidation(t, d[0]["CreationTime"], "2015-01-17 00:00:00")
     st.dataValidation(t, d[0]["BirthYear"], int64(1982))
-    st.dataValidation(t, string(d[0]["Gender"].([]byte)), "Female")
-    st.dataValidation(t, string(d[0]["Nickname"].([]byte)), "Bob")
+    st.dataValidation(t, d[0]["Gender"], "Female")
+    st.dataValidation(t, d[0]["Nickname"], "Bob")
 }
 
 func (st *ServerTest) dataValidation(t *testing.T, l, r interface{}) {
+    // DATETIME and TIMESTAMP columns are time.Time
+    if tm, ok := l.(time.Time); ok {
+        l = tm.Format("2006-01-02 15:04:05")
+    }
     if l != r {
         t.Fatalf("[%s] Value validation fails: %v\t%v\n", st.Server.Type, l, r)
     }
@@ -184,3 +192,319 @@ func TestServer(t *testing.T) {
     st.Init(t)
     st.Start(t)
 }
+
+func TestParseSQL(t *testing.T) {
+    s := NewServer("mysql", "")
+    str, args, _ := s.parseSQL(`SELECT "a""b", "c`+"`"+`d" FROM "t" WHERE "x$1" = $2 AND "y" = 'say "hi" $1' AND "z" = $1`, []interface{}{1, 2})
+    want := "SELECT `a\"b`, `c``d` FROM `t` WHERE `x$1` = ? AND `y` = 'say \"hi\" $1' AND `z` = ?"
+    if str != want {
+        t.Fatalf("[mysql]: %s\n", str)
+    }
+    if len(args) != 2 || args[0] != 2 || args[1] != 1 {
+        t.Fatalf("[mysql]: %#v\n", args)
+    }
+
+    s = NewServer("sqlite3", "")
+    str, args, _ = s.parseSQL(`SELECT "a""b" FROM "t" WHERE "x" = $1 AND "y" = 'it''s $2'`, []interface{}{1})
+    if str != `SELECT "a""b" FROM "t" WHERE "x" = ? AND "y" = 'it''s $2'` || len(args) != 1 {
+        t.Fatalf("[sqlite3]: %s %#v\n", str, args)
+    }
+
+    // $n without argument
+    if _, _, err := s.parseSQL(`SELECT $1, $2`, []interface{}{1}); err == nil {
+        t.Fatalf("[sqlite3]: missing argument must be an error\n")
+    }
+}
+
+func TestTransaction(t *testing.T) {
+    st := testServer("sqlite3", "sqlite3.db")
+    st.Init(t)
+
+    q := `INSERT INTO "passport_user" ("UserID", "CreationTime", "BirthYear", "Gender", "Nickname") VALUES($1, $2, $3, $4, $5)`
+    err := st.Server.Transaction(func(tx *Tx) error {
+        if _, err := tx.Exec(q, 1000000, "2015-01-17 00:00:00", 1980, "Male", "Bob"); err != nil {
+            return err
+        }
+
+        // Uncommitted row is visible in the transaction
+        d := []Item{}
+        if err := tx.Rows(&d, `SELECT * FROM "passport_user" WHERE "UserID" = $1`, 1000000); err != nil {
+            return err
+        }
+        if len(d) != 1 {
+            t.Fatalf("[%s] Returns the number of rows of data is incorrect: %v\n", st.Server.Type, len(d))
+        }
+        return fmt.Errorf("rollback")
+    })
+    if err == nil || err.Error() != "rollback" {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+
+    d := []Item{}
+    if err := st.Server.Rows(&d, `SELECT * FROM "passport_user"`); err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+    if len(d) != 0 {
+        t.Fatalf("[%s] Rolled back row is visible: %v\n", st.Server.Type, len(d))
+    }
+}
+
+type scanUser struct {
+    Nickname string
+    Year     int    `field:"BirthYear"`
+    Sex      string `json:"gender"`
+    ID       int64  `json:"id" field:"UserID"`
+    Note     string
+    note     string
+}
+
+func TestScanStruct(t *testing.T) {
+    st := testServer("sqlite3", "sqlite3.db")
+    st.Init(t)
+
+    q := `INSERT INTO "passport_user" ("UserID", "CreationTime", "BirthYear", "Gender", "Nickname") VALUES($1, $2, $3, $4, $5)`
+    if _, err := st.Server.Exec(q, 1000000, "2015-01-17 00:00:00", 1980, "Male", "Bob"); err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+
+    // Columns in any order, unselected fields keep zero value
+    d := scanUser{}
+    err := st.Server.Row(&d, `SELECT "Gender", "nickname", "UserID", "BirthYear" FROM "passport_user"`)
+    if err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+    if d.ID != 1000000 || d.Year != 1980 || d.Sex != "Male" || d.Nickname != "Bob" || d.Note != "" {
+        t.Fatalf("[%s]: %#v\n", st.Server.Type, d)
+    }
+
+    // Unknown column
+    ds := []scanUser{}
+    err = st.Server.Rows(&ds, `SELECT * FROM "passport_user"`)
+    if err == nil {
+        t.Fatalf("[%s]: unknown column CreationTime must be an error\n", st.Server.Type)
+    }
+
+    st.Server.IgnoreUnknownColumns = true
+    err = st.Server.Rows(&ds, `SELECT * FROM "passport_user"`)
+    if err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+    if len(ds) != 1 || ds[0].ID != 1000000 || ds[0].Nickname != "Bob" {
+        t.Fatalf("[%s]: %#v\n", st.Server.Type, ds)
+    }
+}
+
+type scanLogin struct {
+    LoginID int64
+    Timestamps
+    *Audit `prefix:"Audit"`
+    User   *scanUser
+}
+
+func TestScanNested(t *testing.T) {
+    st := testServer("sqlite3", "sqlite3.db")
+    st.Init(t)
+
+    q := `INSERT INTO "passport_user" ("UserID", "CreationTime", "BirthYear", "Gender", "Nickname") VALUES($1, $2, $3, $4, $5)`
+    if _, err := st.Server.Exec(q, 1000000, "2015-01-17 00:00:00", 1980, "Male", "Bob"); err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+    q = `INSERT INTO "passport_login" ("UserID", "CreationTime", "Source", "LoginIp", "AnonymousID", "AuthCode", "UserAgent") VALUES($1, $2, 1, 0, '', '', $3)`
+    for _, v := range []string{"curl", "wget"} {
+        if _, err := st.Server.Exec(q, 1000000, "2015-01-18 00:00:00", v); err != nil {
+            t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+        }
+    }
+
+    d := []scanLogin{}
+    qy := st.Server.Select("l.LoginID", "l.CreationTime", "l.UserAgent AS AuditBy", "u.UserID AS User.UserID", "u.Nickname AS User.Nickname")
+    err := qy.From("passport_login AS l").Join("passport_user AS u").On(`"u"."UserID" = "l"."UserID"`).OrderAsc("l.LoginID").Rows(&d)
+    if err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+    if len(d) != 2 || d[0].CreationTime != "2015-01-18 00:00:00" || d[0].By != "curl" || d[1].By != "wget" {
+        t.Fatalf("[%s]: %#v\n", st.Server.Type, d)
+    }
+    if d[0].User == nil || d[0].User.ID != 1000000 || d[0].User.Nickname != "Bob" || d[0].User == d[1].User {
+        t.Fatalf("[%s]: %#v\n", st.Server.Type, d[0].User)
+    }
+}
+
+type scanNull struct {
+    Nickname string
+    Year     int64
+    Time     time.Time
+    Gender   *string
+    Note     sql.NullString
+}
+
+func TestScanNull(t *testing.T) {
+    s := NewServer("sqlite3", "sqlite3.db")
+    q := `SELECT NULL AS "Nickname", NULL AS "Year", NULL AS "Time", NULL AS "Gender", NULL AS "Note" UNION ALL SELECT 'Bob', 1980, NULL, 'Male', 'x'`
+
+    d := []scanNull{}
+    if err := s.Rows(&d, q); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    if len(d) != 2 || d[0].Nickname != "" || d[0].Year != 0 || !d[0].Time.IsZero() || d[0].Gender != nil || d[0].Note.Valid {
+        t.Fatalf("[%s]: %#v\n", s.Type, d)
+    }
+    if d[1].Nickname != "Bob" || d[1].Year != 1980 || d[1].Gender == nil || *d[1].Gender != "Male" || d[1].Note.String != "x" {
+        t.Fatalf("[%s]: %#v\n", s.Type, d[1])
+    }
+
+    // NULL in Item is nil
+    di := []Item{}
+    if err := s.Rows(&di, q); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    if v, ok := di[0]["Nickname"]; !ok || v != nil {
+        t.Fatalf("[%s]: %#v\n", s.Type, di[0])
+    }
+
+    s.StrictNull = true
+    if err := s.Rows(&d, q); err == nil {
+        t.Fatalf("[%s]: NULL into string must be an error\n", s.Type)
+    }
+}
+
+func TestCall(t *testing.T) {
+    str, err := NewServer("mysql", "").callSQL("report.monthly", 2)
+    if err != nil || str != `CALL "report"."monthly"($1, $2)` {
+        t.Fatalf("[mysql]: %s %v\n", str, err)
+    }
+    str, err = NewServer("postgres", "").callSQL("monthly", 0)
+    if err != nil || str != `SELECT * FROM "monthly"()` {
+        t.Fatalf("[postgres]: %s %v\n", str, err)
+    }
+    if _, err = NewServer("sqlite3", "sqlite3.db").Call("monthly"); err == nil {
+        t.Fatalf("[sqlite3]: CALL must be an error\n")
+    }
+}
+
+func TestResults(t *testing.T) {
+    st := testServer("sqlite3", "sqlite3.db")
+    st.Init(t)
+
+    q := `INSERT INTO "passport_user" ("UserID", "CreationTime", "BirthYear", "Gender", "Nickname") VALUES($1, $2, $3, $4, $5)`
+    if _, err := st.Server.Exec(q, 1000000, "2015-01-17 00:00:00", 1980, "Male", "Bob"); err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+
+    r, err := st.Server.Results(`SELECT "UserID", "Nickname" FROM "passport_user" WHERE "BirthYear" = $1`, 1980)
+    if err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+    defer r.Close()
+
+    d := []Item{}
+    if err := r.Rows(&d); err != nil || len(d) != 1 || d[0]["Nickname"] != "Bob" {
+        t.Fatalf("[%s]: %v %v\n", st.Server.Type, d, err)
+    }
+    if err := r.Rows(&d); err != ErrNoResultSet {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+}
+
+// Map stored as JSON text
+type valuerAttrs map[string]interface{}
+
+func (a valuerAttrs) Value() (driver.Value, error) {
+    b, err := json.Marshal(a)
+    return string(b), err
+}
+
+// Struct with a pointer receiver Value
+type valuerPoint struct {
+    X, Y int
+}
+
+func (p *valuerPoint) Value() (driver.Value, error) {
+    return fmt.Sprintf("(%d,%d)", p.X, p.Y), nil
+}
+
+func TestValuerArg(t *testing.T) {
+    st := testServer("sqlite3", "sqlite3.db")
+    st.Init(t)
+    s := st.Server
+    for _, v := range []string{`DROP TABLE IF EXISTS "valuer_arg"`, `CREATE TABLE "valuer_arg" ("A" TEXT NOT NULL)`} {
+        if _, err := s.Exec(v); err != nil {
+            t.Fatalf("[%s]: %v\n", s.Type, err)
+        }
+    }
+
+    if _, err := s.Exec(`INSERT INTO "valuer_arg" ("A") VALUES ($1)`, valuerAttrs{"x": 1}); err != nil {
+        t.Fatalf("[%s]: %v\n", s.Type, err)
+    }
+    var a string
+    if err := s.Row(&a, `SELECT "A" FROM "valuer_arg" WHERE "A" = $1`, valuerAttrs{"x": 1}); err != nil || a != `{"x":1}` {
+        t.Fatalf("[%s]: %s %v\n", s.Type, a, err)
+    }
+
+    // Too few arguments is an error, not a panic
+    if _, err := s.Exec(`INSERT INTO "valuer_arg" ("A") VALUES ($1)`); err == nil {
+        t.Fatalf("[%s]: missing argument must be an error\n", s.Type)
+    }
+}
+
+func TestBindNamed(t *testing.T) {
+    s := NewServer("postgres", "")
+    str, args, err := s.bindNamed(`SELECT "a"::text, ':x' FROM "t" WHERE "x" = :id OR "y" = @id AND "z" = :Nickname`, []interface{}{Item{"id": 1, "nickname": "Bob"}})
+    if err != nil || str != `SELECT "a"::text, ':x' FROM "t" WHERE "x" = $1 OR "y" = $1 AND "z" = $2` {
+        t.Fatalf("[postgres]: %s %v\n", str, err)
+    }
+    if len(args) != 2 || args[0] != 1 || args[1] != "Bob" {
+        t.Fatalf("[postgres]: %#v\n", args)
+    }
+
+    // Repeated names repeat arguments for ?
+    s = NewServer("mysql", "")
+    str, args, _ = s.bindNamed(`SELECT @@version, "x" FROM "t" WHERE "a" = :id OR "b" = :id`, []interface{}{sql.Named("id", 7)})
+    str, args, _ = s.parseSQL(str, args)
+    if str != "SELECT @@version, `x` FROM `t` WHERE `a` = ? OR `b` = ?" || len(args) != 2 || args[1] != 7 {
+        t.Fatalf("[mysql]: %s %#v\n", str, args)
+    }
+
+    // Struct by column name
+    u := struct {
+        UserID   int64 `field:"UID"`
+        Nickname string
+    }{1000000, "Bob"}
+    _, args, err = s.bindNamed(`SELECT * FROM "t" WHERE "UserID" = :UID AND "Nickname" = :Nickname`, []interface{}{&u})
+    if err != nil || len(args) != 2 || args[0] != int64(1000000) {
+        t.Fatalf("[mysql]: %#v %v\n", args, err)
+    }
+    if _, _, err = s.bindNamed(`SELECT :missing`, []interface{}{u}); err == nil {
+        t.Fatalf("[mysql]: missing name must be an error\n")
+    }
+
+    // Positional arguments are left as is
+    str, args, _ = s.bindNamed(`SELECT :a`, []interface{}{1})
+    if str != `SELECT :a` || len(args) != 1 {
+        t.Fatalf("[mysql]: %s %#v\n", str, args)
+    }
+
+    // A map or struct is positional without named parameters, or if it is a driver.Valuer
+    for _, v := range []interface{}{Item{"a": 1}, valuerAttrs{"a": 1}, valuerPoint{1, 2}, &valuerPoint{1, 2}} {
+        str, args, err = s.bindNamed(`SELECT $1`, []interface{}{v})
+        if err != nil || str != `SELECT $1` || len(args) != 1 {
+            t.Fatalf("[mysql]: %T %s %#v %v\n", v, str, args, err)
+        }
+    }
+    str, args, err = s.bindNamed(`SELECT :a, $1`, []interface{}{valuerAttrs{"a": 1}})
+    if err != nil || str != `SELECT :a, $1` || len(args) != 1 {
+        t.Fatalf("[mysql]: %s %#v %v\n", str, args, err)
+    }
+
+    // Exec and Rows
+    st := testServer("sqlite3", "sqlite3.db")
+    st.Init(t)
+    q := `INSERT INTO "passport_user" ("UserID", "CreationTime", "BirthYear", "Gender", "Nickname") VALUES(:UserID, :CreationTime, :BirthYear, :Gender, :Nickname)`
+    if _, err := st.Server.Exec(q, Item{"UserID": 1000000, "CreationTime": "2015-01-17 00:00:00", "BirthYear": 1980, "Gender": "Male", "Nickname": "肯·汤普逊"}); err != nil {
+        t.Fatalf("[%s]: %v\n", st.Server.Type, err)
+    }
+    d := []Item{}
+    if err := st.Server.Rows(&d, `SELECT * FROM "passport_user" WHERE "Nickname" = @name`, sql.Named("name", "肯·汤普逊")); err != nil || len(d) != 1 {
+        t.Fatalf("[%s]: %v %v\n", st.Server.Type, d, err)
+    }
+}
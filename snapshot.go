@@ -0,0 +1,192 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Column values of entities as loaded or saved, by entity pointer
+type snapshots struct {
+	mu sync.Mutex
+	m  map[interface{}]Item
+}
+
+// Copy of model that snapshots entities it finds, creates and saves, and those
+// its Select queries scan by Row, Rows and Iter. Save then updates changed
+// columns only. Snapshots hold the entities until
+// Forget, Remove or Reset: use a tracked model for one unit of work, like a
+// request, then discard it. Copies by WithTx and Unscoped share its snapshots.
+func (m *Model) Tracked() *Model {
+	c := *m
+	c.snapshots = &snapshots{m: make(map[interface{}]Item)}
+	return &c
+}
+
+// Drop all snapshots
+func (m *Model) Reset() {
+	if m.snapshots == nil {
+		return
+	}
+
+	m.snapshots.mu.Lock()
+	m.snapshots.m = make(map[interface{}]Item)
+	m.snapshots.mu.Unlock()
+}
+
+// Record column values of entity, a pointer, on a tracked model
+func (m *Model) Snapshot(entity interface{}) error {
+	if m.snapshots == nil {
+		return fmt.Errorf("model of table %s is not tracked", m.Table.Name)
+	}
+	if err := m.checkEntity(entity, true); err != nil {
+		return err
+	}
+	return m.snapshots.add(entity)
+}
+
+// Record column values of entity, a pointer
+func (s *snapshots) add(entity interface{}) error {
+	d, err := toItem(entity)
+	if err != nil {
+		return err
+	}
+	for k, v := range d {
+		d[k] = plainValue(v)
+	}
+
+	s.mu.Lock()
+	s.m[entity] = d
+	s.mu.Unlock()
+	return nil
+}
+
+// Snapshot entities scanned into ptr, a pointer to an entity or to a slice
+// of entities or entity pointers, if the query is of a tracked model
+func (q *Query) track(ptr interface{}) error {
+	if q.snapshots == nil || q.Table == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil
+	}
+	if v = v.Elem(); v.Type() == q.Table.EntityType {
+		return q.snapshots.add(ptr)
+	}
+	if v.Kind() != reflect.Slice {
+		return nil
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		e := v.Index(i)
+		if e.Kind() != reflect.Ptr {
+			e = e.Addr()
+		}
+		if e.IsNil() || e.Type().Elem() != q.Table.EntityType {
+			continue
+		}
+		if err := q.snapshots.add(e.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop snapshot of entity. For an entity passed by value, snapshots of
+// entities with its primary key are dropped.
+func (m *Model) Forget(entity interface{}) {
+	if m.snapshots == nil {
+		return
+	}
+
+	m.snapshots.mu.Lock()
+	defer m.snapshots.mu.Unlock()
+	if reflect.ValueOf(entity).Kind() == reflect.Ptr {
+		delete(m.snapshots.m, entity)
+		return
+	}
+
+	w, _, err := m.Table.primaryWhere(entity)
+	if err != nil {
+		return
+	}
+	for k, snap := range m.snapshots.m {
+		if len(changed(Item(w), snap)) == 0 {
+			delete(m.snapshots.m, k)
+		}
+	}
+}
+
+// Columns of entity changed since its snapshot, ok is false if it has none
+func (m *Model) Changes(entity interface{}) (d Item, ok bool, err error) {
+	snap, ok := m.snapshot(entity)
+	if !ok {
+		return nil, false, nil
+	}
+
+	d, err = toItem(entity)
+	if err != nil {
+		return nil, true, err
+	}
+	return changed(d, snap), true, nil
+}
+
+// Snapshot of entity, if any
+func (m *Model) snapshot(entity interface{}) (Item, bool) {
+	if m.snapshots == nil {
+		return nil, false
+	}
+
+	m.snapshots.mu.Lock()
+	defer m.snapshots.mu.Unlock()
+	d, ok := m.snapshots.m[entity]
+	return d, ok
+}
+
+// Snapshot entity if the model is tracked
+func (m *Model) track(entity interface{}) error {
+	if m.snapshots == nil {
+		return nil
+	}
+	return m.Snapshot(entity)
+}
+
+// Items of d that differ from snap
+func changed(d Item, snap Item) Item {
+	r := make(Item, len(d))
+	for k, v := range d {
+		if s, ok := snap[k]; !ok || !sameValue(v, s) {
+			r[k] = v
+		}
+	}
+	return r
+}
+
+// Whether column values are equal, times by instant
+func sameValue(a, b interface{}) bool {
+	a, b = plainValue(a), plainValue(b)
+	if t, ok := a.(time.Time); ok {
+		u, ok := b.(time.Time)
+		return ok && t.Equal(u)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Value of non-nil pointer v, copy of []byte v. A snapshot so holds values
+// the entity can not change in place.
+func plainValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return append([]byte(nil), b...)
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		return plainValue(rv.Elem().Interface())
+	}
+	return v
+}
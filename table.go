@@ -5,7 +5,13 @@
 package db
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Table struct
@@ -13,19 +19,22 @@ type Table struct {
 	// Table name
 	Name string
 
-	// Table primary
+	// Table primary, the first one of a composite key
 	Primary string
 
+	// Table primary fields, composite key
+	Primaries []string
+
 	// All fields, except primary
 	Fields []string
 
 	// Fields for select, include primary
 	SelectFields []string
 
-	// Fields for add
+	// Fields for add, those NewTable picks if nil
 	AddFields []string
 
-	// Fields for update
+	// Fields for update, those NewTable picks if nil
 	UpdateFields []string
 
 	// json and field property map
@@ -33,50 +42,582 @@ type Table struct {
 
 	// Entity type
 	EntityType reflect.Type
+
+	// Column metadata, in field order
+	Columns []Column
+
+	// Relations to other tables, loaded by Query.Preload
+	Relations []Relation
+
+	// Clock of created and updated columns, time.Now if nil
+	Now func() time.Time
+
+	// Time zone of created and updated columns, the clock's if nil
+	Location *time.Location
+
+	// AddFields and UpdateFields picked by NewTable, used if those are nil
+	defaultAddFields    []string
+	defaultUpdateFields []string
+}
+
+// Column metadata from the db tag
+type Column struct {
+	// Column name
+	Name string
+
+	// Struct field name
+	Field string
+
+	// Struct field type
+	Type reflect.Type
+
+	// Primary key, also pk:"true"
+	PK bool
+
+	// Generated by the database, zero value is not inserted
+	AutoIncr bool
+
+	// Selected only, never inserted or updated
+	ReadOnly bool
+
+	// Inserted, never updated
+	InsertOnly bool
+
+	// Zero value is not inserted or updated
+	OmitEmpty bool
+
+	// Stored as JSON text
+	JSON bool
+
+	// Has a database default, zero value is not inserted
+	Default bool
+
+	// Set to the current time on insert if zero
+	Created bool
+
+	// Set to the current time on insert and update
+	Updated bool
+
+	// Soft delete time, NULL if the row is not deleted
+	SoftDelete bool
+
+	// Optimistic lock version, incremented by each update
+	Version bool
+
+	// Index for reflect.Value.FieldByIndex
+	index []int
 }
 
-// New Table
+// New Table. Embedded structs are flattened, their columns get the prefix
+// of the prefix tag if any. Nested struct fields are not columns of the table.
+//
+// Columns are described by the db tag:
+//
+//	`db:"name,pk,autoincr,readonly,insertonly,omitempty,default,created,updated,softdelete,version"`
+//
+// The field tag still names the column and pk:"true" still marks the primary key.
+// AddFields get all columns but primary key, readonly and softdelete ones,
+// UpdateFields also leave out insertonly, created and version ones. Zero values
+// of autoincr and default columns are not inserted.
 func NewTable(tableName string, entity interface{}) *Table {
-	primary := ""
+	primaries := make([]string, 0)
 	fields := make([]string, 0)
 	selectFields := make([]string, 0)
 	addFields := make([]string, 0)
 	updateFields := make([]string, 0)
 	filedsMap := make(map[string]string)
+	columns := make([]Column, 0)
 	typ := reflect.Indirect(reflect.ValueOf(entity)).Type()
 
-	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
-
-		fd := field.Name
-		if field.Tag.Get("field") != "" {
-			fd = field.Tag.Get("field")
+	for _, field := range structFields(typ) {
+		if field.Nested {
+			continue
 		}
 
-		jn := field.Name
-		if field.Tag.Get("json") != "" {
-			jn = field.Tag.Get("json")
-		}
+		c := newColumn(field)
+		columns = append(columns, c)
 
-		//!field.Anonymous
-		if field.Tag.Get("pk") == "true" {
-			primary = fd
+		fd := field.Column
+		if c.PK {
+			primaries = append(primaries, fd)
 		} else {
 			fields = append(fields, fd)
+			if !c.ReadOnly && !c.SoftDelete {
+				addFields = append(addFields, fd)
+				if !c.InsertOnly && !c.Created && !c.Version {
+					updateFields = append(updateFields, fd)
+				}
+			}
 		}
 
 		selectFields = append(selectFields, fd)
-		filedsMap[jn] = fd
+		filedsMap[field.JSON] = fd
+	}
+
+	primary := ""
+	if len(primaries) > 0 {
+		primary = primaries[0]
 	}
 
 	return &Table{
-		Name:         tableName,
-		Primary:      primary,
-		Fields:       fields,
-		SelectFields: selectFields,
-		AddFields:    addFields,
-		UpdateFields: updateFields,
-		FiledsMap:    filedsMap,
-		EntityType:   typ,
+		Name:                tableName,
+		Primary:             primary,
+		Primaries:           primaries,
+		Fields:              fields,
+		SelectFields:        selectFields,
+		AddFields:           addFields,
+		UpdateFields:        updateFields,
+		FiledsMap:           filedsMap,
+		EntityType:          typ,
+		Columns:             columns,
+		defaultAddFields:    append(make([]string, 0, len(addFields)), addFields...),
+		defaultUpdateFields: append(make([]string, 0, len(updateFields)), updateFields...),
+	}
+}
+
+// Column metadata of field
+func newColumn(f structField) Column {
+	has := func(option string) bool {
+		_, ok := f.Options[option]
+		return ok
+	}
+
+	c := Column{
+		Name:       f.Column,
+		Field:      f.Name,
+		Type:       f.Field.Type,
+		PK:         has("pk") || f.Field.Tag.Get("pk") == "true",
+		AutoIncr:   has("autoincr"),
+		ReadOnly:   has("readonly"),
+		InsertOnly: has("insertonly"),
+		OmitEmpty:  has("omitempty"),
+		JSON:       has("json"),
+		Default:    has("default"),
+		Created:    has("created"),
+		Updated:    has("updated"),
+		SoftDelete: has("softdelete"),
+		Version:    has("version"),
+		index:      f.Index,
+	}
+	return c
+}
+
+// Column by name
+func (t *Table) Column(name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// Struct field mapped to a column
+type structField struct {
+	// Column name: prefix + field tag, db tag name or field name
+	Column string
+
+	// json tag or field name
+	JSON string
+
+	// Field name
+	Name string
+
+	// Index for reflect.Value.FieldByIndex
+	Index []int
+
+	// Nested struct, not a column
+	Nested bool
+
+	// Options of db tag, like "json"
+	Options map[string]string
+
+	// Struct field
+	Field reflect.StructField
+}
+
+// Lower case names to match result columns: column, json, field name
+func (f structField) names() []string {
+	return []string{strings.ToLower(f.Column), strings.ToLower(f.JSON), strings.ToLower(f.Name)}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	valuerType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+// Struct types stored in one column, like time.Time and sql.NullString
+func isValueType(t reflect.Type) bool {
+	return t == timeType || t.Implements(valuerType) || reflect.PtrTo(t).Implements(scannerType)
+}
+
+// Struct or pointer to struct that is not stored in one column
+func isNestedType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && !isValueType(t)
+}
+
+// Exported fields of typ, embedded structs are flattened
+func structFields(typ reflect.Type) []structField {
+	fields := make([]structField, 0)
+	walkFields(typ, "", nil, map[reflect.Type]bool{}, &fields)
+
+	// Shallower fields come first, like Go field promotion
+	sort.SliceStable(fields, func(i, j int) bool {
+		return len(fields[i].Index) < len(fields[j].Index)
+	})
+	return fields
+}
+
+// Walk fields of typ
+func walkFields(typ reflect.Type, prefix string, index []int, visited map[reflect.Type]bool, fields *[]structField) {
+	visited[typ] = true
+	defer delete(visited, typ)
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		idx := append(append([]int{}, index...), i)
+
+		if f.Anonymous && isNestedType(f.Type) {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				// Unexported embedded pointer can not be allocated
+				if f.PkgPath != "" {
+					continue
+				}
+				ft = ft.Elem()
+			}
+			if !visited[ft] {
+				walkFields(ft, prefix+f.Tag.Get("prefix"), idx, visited, fields)
+			}
+			continue
+		}
+
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		name, options := parseTag(f.Tag.Get("db"))
+		column := f.Name
+		if tag := strings.Split(f.Tag.Get("field"), ",")[0]; tag != "" {
+			column = tag
+		} else if name != "" {
+			column = name
+		}
+		if column == "-" {
+			continue
+		}
+
+		jn := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+			jn = tag
+		}
+
+		*fields = append(*fields, structField{
+			Column:  prefix + column,
+			JSON:    jn,
+			Name:    f.Name,
+			Index:   idx,
+			Nested:  !isJSON(options) && (isNestedType(f.Type) || (f.Type.Kind() == reflect.Slice && isNestedType(f.Type.Elem()))),
+			Options: options,
+			Field:   f,
+		})
+	}
+}
+
+// Parse db tag "name,option,key=value", return name and options
+func parseTag(tag string) (string, map[string]string) {
+	options := make(map[string]string)
+	ps := strings.Split(tag, ",")
+	for _, p := range ps[1:] {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 {
+			options[kv[0]] = kv[1]
+		} else {
+			options[p] = ""
+		}
+	}
+	return strings.TrimSpace(ps[0]), options
+}
+
+// Field is stored as JSON text
+func isJSON(options map[string]string) bool {
+	_, ok := options["json"]
+	return ok
+}
+
+// Primary fields
+func (t *Table) primaries() []string {
+	if len(t.Primaries) == 0 && t.Primary != "" {
+		return []string{t.Primary}
+	}
+	return t.Primaries
+}
+
+// Fields of primary key, in key order
+func (t *Table) primaryFields() ([]structField, error) {
+	ps := t.primaries()
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key", t.Name)
+	}
+
+	fs := make([]structField, 0, len(ps))
+	all := structFields(t.EntityType)
+	for _, p := range ps {
+		for _, f := range all {
+			if !f.Nested && f.Column == p {
+				fs = append(fs, f)
+				break
+			}
+		}
+	}
+	if len(fs) != len(ps) {
+		return nil, fmt.Errorf("table %s has no primary key field", t.Name)
+	}
+	return fs, nil
+}
+
+// Columns of entity to insert: AddFields, those NewTable picks if nil. Empty
+// AddFields insert none. Zero primary key, autoincr and default columns are
+// left to the database, zero omitempty columns are left out.
+func (t *Table) insertItem(entity interface{}) (Item, error) {
+	item, err := toItem(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := t.AddFields
+	if fields == nil {
+		fields = t.defaultFields(t.defaultAddFields)
+	}
+	d := t.omitEmpty(pick(item, fields))
+	for _, c := range t.Columns {
+		if v, ok := d[c.Name]; ok && (c.AutoIncr || c.Default) && isZero(v) {
+			delete(d, c.Name)
+		}
+	}
+
+	for _, p := range t.primaries() {
+		if v, ok := item[p]; ok && !isZero(v) {
+			d[p] = v
+		}
+	}
+	return d, nil
+}
+
+// Columns of entity to update: UpdateFields, those NewTable picks if nil.
+// Zero omitempty columns are left out.
+func (t *Table) updateItem(entity interface{}) (Item, error) {
+	item, err := toItem(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := t.UpdateFields
+	if fields == nil {
+		fields = t.defaultFields(t.defaultUpdateFields)
+	}
+	d := t.omitEmpty(pick(item, fields))
+	for _, p := range t.primaries() {
+		delete(d, p)
+	}
+	return d, nil
+}
+
+// Fields picked by NewTable, all fields of a table it did not make
+func (t *Table) defaultFields(picked []string) []string {
+	if picked == nil {
+		return t.Fields
+	}
+	return picked
+}
+
+// Delete zero values of omitempty columns from d
+func (t *Table) omitEmpty(d Item) Item {
+	for _, c := range t.Columns {
+		if v, ok := d[c.Name]; ok && c.OmitEmpty && isZero(v) {
+			delete(d, c.Name)
+		}
+	}
+	return d
+}
+
+// Primary key of entity as where, zero reports whether any key column is zero
+func (t *Table) primaryWhere(entity interface{}) (w Where, zero bool, err error) {
+	fs, err := t.primaryFields()
+	if err != nil {
+		return nil, false, err
+	}
+
+	w = make(Where, len(fs))
+	val := reflect.Indirect(reflect.ValueOf(entity))
+	for _, f := range fs {
+		v, ok := fieldValue(val, f.Index)
+		if !ok {
+			return nil, false, fmt.Errorf("table %s: primary key field is under a nil pointer", t.Name)
+		}
+		w[f.Column] = v.Interface()
+		zero = zero || v.IsZero()
+	}
+	return w, zero, nil
+}
+
+// Primary key values, in key order, as where
+func (t *Table) keyWhere(pk []interface{}) (Where, error) {
+	ps := t.primaries()
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key", t.Name)
+	}
+	if len(pk) != len(ps) {
+		return nil, fmt.Errorf("table %s: primary key has %d columns, got %d values", t.Name, len(ps), len(pk))
+	}
+
+	w := make(Where, len(pk))
+	for i, p := range ps {
+		w[p] = pk[i]
+	}
+	return w, nil
+}
+
+// Write generated keys back to zero primary key fields of entity
+func (t *Table) setKeys(entity interface{}, keys Item) {
+	fs, err := t.primaryFields()
+	if err != nil {
+		return
+	}
+
+	for _, f := range fs {
+		k, ok := keys[f.Column]
+		if !ok || k == nil {
+			continue
+		}
+
+		v := fieldByIndex(reflect.ValueOf(entity).Elem(), f.Index)
+		kv := reflect.ValueOf(k)
+		// int64 converts to string as a rune, not wanted
+		if v.IsZero() && kv.Type().ConvertibleTo(v.Type()) && (kv.Kind() == reflect.String) == (v.Kind() == reflect.String) {
+			v.Set(kv.Convert(v.Type()))
+		}
+	}
+}
+
+// Current time of created and updated columns
+func (t *Table) now() time.Time {
+	now := time.Now
+	if t.Now != nil {
+		now = t.Now
+	}
+
+	n := now()
+	if t.Location != nil {
+		n = n.In(t.Location)
+	}
+	return n
+}
+
+// Set created (insert, if zero) and updated columns of entity, a pointer to struct
+func (t *Table) touch(entity interface{}, insert bool) {
+	now := t.now()
+	val := reflect.ValueOf(entity).Elem()
+	for _, c := range t.Columns {
+		if !c.Updated && !(c.Created && insert) {
+			continue
+		}
+
+		f := fieldByIndex(val, c.index)
+		if c.Created && !c.Updated && !f.IsZero() {
+			continue
+		}
+		if v, ok := timestamp(f.Type(), now); ok {
+			f.Set(reflect.ValueOf(v))
+		}
+	}
+}
+
+// Add created (insert) and updated columns missing in d
+func (t *Table) touchItem(d Item, insert bool) {
+	now := t.now()
+	for _, c := range t.Columns {
+		if !c.Updated && !(c.Created && insert) {
+			continue
+		}
+
+		if _, ok := d[c.Name]; ok {
+			continue
+		}
+		if v, ok := timestamp(c.Type, now); ok {
+			d[c.Name] = v
+		}
+	}
+}
+
+// Soft delete column, if any
+func (t *Table) softDelete() (Column, bool) {
+	for _, c := range t.Columns {
+		if c.SoftDelete {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// Version column of entity, a pointer to struct, if any
+func (t *Table) version(entity interface{}) (Column, reflect.Value, bool) {
+	for _, c := range t.Columns {
+		if c.Version {
+			return c, fieldByIndex(reflect.ValueOf(entity).Elem(), c.index), true
+		}
+	}
+	return Column{}, reflect.Value{}, false
+}
+
+// Add n to integer field v
+func addInt(v reflect.Value, n int64) {
+	switch {
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		v.SetInt(v.Int() + n)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		v.SetUint(v.Uint() + uint64(n))
+	}
+}
+
+// Layout of timestamps in string fields
+const timestampLayout = "2006-01-02 15:04:05"
+
+// now as a value of typ: time.Time, *time.Time, string or unix seconds
+func timestamp(typ reflect.Type, now time.Time) (interface{}, bool) {
+	switch {
+	case typ == timeType:
+		return now, true
+	case typ.Kind() == reflect.Ptr && typ.Elem() == timeType:
+		return &now, true
+	case typ.Kind() == reflect.String:
+		return reflect.ValueOf(now.Format(timestampLayout)).Convert(typ).Interface(), true
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Int64:
+		return reflect.ValueOf(now.Unix()).Convert(typ).Interface(), true
+	}
+	return nil, false
+}
+
+// nil or zero value
+func isZero(v interface{}) bool {
+	return v == nil || reflect.ValueOf(v).IsZero()
+}
+
+// Items of d in fields
+func pick(d Item, fields []string) Item {
+	r := make(Item, len(fields))
+	for _, f := range fields {
+		if v, ok := d[f]; ok {
+			r[f] = v
+		}
 	}
+	return r
 }
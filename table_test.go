@@ -0,0 +1,167 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+    "reflect"
+    "testing"
+)
+
+type Timestamps struct {
+    CreationTime string
+    UpdateTime   string `field:"UpdatedAt"`
+}
+
+type Audit struct {
+    By string
+}
+
+type Profile struct {
+    Nickname string
+    Owner    *tableUser
+}
+
+type tableUser struct {
+    UserID int64 `pk:"true" json:"id"`
+    Timestamps
+    *Audit  `prefix:"Audit"`
+    Profile Profile
+    Logins  []Profile
+}
+
+func TestNewTable(t *testing.T) {
+    tb := NewTable("passport_user", tableUser{})
+    if tb.Primary != "UserID" {
+        t.Fatalf("Primary: %s\n", tb.Primary)
+    }
+
+    fields := []string{"CreationTime", "UpdatedAt", "AuditBy"}
+    if !reflect.DeepEqual(tb.Fields, fields) {
+        t.Fatalf("Fields: %#v\n", tb.Fields)
+    }
+    if !reflect.DeepEqual(tb.SelectFields, append([]string{"UserID"}, fields...)) {
+        t.Fatalf("SelectFields: %#v\n", tb.SelectFields)
+    }
+    if tb.FiledsMap["id"] != "UserID" {
+        t.Fatalf("FiledsMap: %#v\n", tb.FiledsMap)
+    }
+}
+
+func TestFieldIndexes(t *testing.T) {
+    indexes := fieldIndexes(reflect.TypeOf(tableUser{}))
+    want := map[string][]int{
+        "userid":           []int{0},
+        "id":               []int{0},
+        "updatedat":        []int{1, 1},
+        "updatetime":       []int{1, 1},
+        "auditby":          []int{2, 0},
+        "by":               []int{2, 0},
+        "profile.nickname": []int{3, 0},
+    }
+    for k, v := range want {
+        if !reflect.DeepEqual(indexes[k], v) {
+            t.Fatalf("%s: %v, want %v\n", k, indexes[k], v)
+        }
+    }
+    if _, ok := indexes["profile.owner.userid"]; ok {
+        t.Fatalf("recursive type must not be expanded\n")
+    }
+}
+
+type tagUser struct {
+    ID        int64             `db:"UserID,pk,autoincr"`
+    Nickname  string            `db:",omitempty"`
+    Gender    string            `db:",default"`
+    Email     string            `db:",omitempty"`
+    Created   string            `db:"CreationTime,insertonly"`
+    Logins    int64             `db:",readonly"`
+    Settings  map[string]string `db:",json"`
+    Legacy    string            `field:"OldName"`
+    Ignored   string            `db:"-"`
+}
+
+func TestTableTags(t *testing.T) {
+    tb := NewTable("passport_user", tagUser{})
+    if tb.Primary != "UserID" {
+        t.Fatalf("Primary: %s\n", tb.Primary)
+    }
+    if want := []string{"Nickname", "Gender", "Email", "CreationTime", "Settings", "OldName"}; !reflect.DeepEqual(tb.AddFields, want) {
+        t.Fatalf("AddFields: %#v\n", tb.AddFields)
+    }
+    if want := []string{"Nickname", "Gender", "Email", "Settings", "OldName"}; !reflect.DeepEqual(tb.UpdateFields, want) {
+        t.Fatalf("UpdateFields: %#v\n", tb.UpdateFields)
+    }
+    if len(tb.SelectFields) != 8 {
+        t.Fatalf("SelectFields: %#v\n", tb.SelectFields)
+    }
+
+    c, ok := tb.Column("UserID")
+    if !ok || !c.PK || !c.AutoIncr || c.Field != "ID" {
+        t.Fatalf("UserID: %#v\n", c)
+    }
+    c, _ = tb.Column("Gender")
+    if !c.Default || c.AutoIncr {
+        t.Fatalf("Gender: %#v\n", c)
+    }
+    if c, _ = tb.Column("Settings"); !c.JSON {
+        t.Fatalf("Settings: %#v\n", c)
+    }
+
+    // Zero primary key, default and omitempty columns are left out
+    d, err := tb.insertItem(&tagUser{Nickname: "Bob", Logins: 3})
+    if err != nil {
+        t.Fatalf("insertItem: %v\n", err)
+    }
+    if _, ok := d["UserID"]; ok || len(d) != 4 || d["Nickname"] != "Bob" {
+        t.Fatalf("insertItem: %#v\n", d)
+    }
+    if _, ok := d["Gender"]; ok {
+        t.Fatalf("insertItem: %#v\n", d)
+    }
+    d, _ = tb.insertItem(&tagUser{Gender: "Female"})
+    if _, ok := d["Nickname"]; ok || d["Gender"] != "Female" || len(d) != 4 {
+        t.Fatalf("insertItem: %#v\n", d)
+    }
+    d, _ = tb.updateItem(&tagUser{ID: 1, Email: "bob@example.com"})
+    if _, ok := d["CreationTime"]; ok || d["Email"] != "bob@example.com" || len(d) != 4 {
+        t.Fatalf("updateItem: %#v\n", d)
+    }
+
+    // Excluded columns are not written, even if no column is left
+    type counter struct {
+        ID    int64 `db:",pk"`
+        Hits  int64 `db:",readonly"`
+        Since int64 `db:",insertonly"`
+    }
+    tc := NewTable("counter", counter{})
+    if d, _ = tc.insertItem(&counter{ID: 1, Hits: 2, Since: 3}); len(d) != 2 || d["ID"] != int64(1) || d["Since"] != int64(3) {
+        t.Fatalf("insertItem: %#v\n", d)
+    }
+    if d, _ = tc.updateItem(&counter{ID: 1, Hits: 2, Since: 3}); len(d) != 0 {
+        t.Fatalf("updateItem: %#v\n", d)
+    }
+
+    // Nil fields mean those NewTable picks
+    tc.AddFields, tc.UpdateFields = nil, nil
+    if d, _ = tc.insertItem(&counter{ID: 1, Hits: 2, Since: 3}); len(d) != 2 || d["Since"] != int64(3) {
+        t.Fatalf("insertItem: %#v\n", d)
+    }
+    if d, _ = tc.updateItem(&counter{ID: 1, Hits: 2, Since: 3}); len(d) != 0 {
+        t.Fatalf("updateItem: %#v\n", d)
+    }
+
+    // Zero non-key autoincr columns are left to the database
+    type ticket struct {
+        ID     int64 `db:",pk"`
+        Serial int64 `db:",autoincr"`
+    }
+    tt := NewTable("ticket", ticket{})
+    if d, _ = tt.insertItem(&ticket{ID: 1}); len(d) != 1 {
+        t.Fatalf("insertItem: %#v\n", d)
+    }
+    if d, _ = tt.insertItem(&ticket{ID: 1, Serial: 7}); len(d) != 2 || d["Serial"] != int64(7) {
+        t.Fatalf("insertItem: %#v\n", d)
+    }
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// *sql.DB or *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// *Server or *Tx
+type executor interface {
+	ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error)
+	RowContext(ctx context.Context, ptr interface{}, sql string, args ...interface{}) error
+	RowsContext(ctx context.Context, ptr interface{}, sql string, args ...interface{}) error
+	IterContext(ctx context.Context, sql string, args ...interface{}) (*Iter, error)
+}
+
+// Transaction
+type Tx struct {
+	// Server
+	Server *Server
+
+	// Underlying transaction
+	tx *sql.Tx
+}
+
+// Commit
+func (t *Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback
+func (t *Tx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// Execute query in transaction, only return sql.Result
+func (t *Tx) Exec(sql string, args ...interface{}) (sql.Result, error) {
+	return t.ExecContext(context.Background(), sql, args...)
+}
+
+// Execute query in transaction with context
+func (t *Tx) ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	return t.Server.exec(ctx, t.tx, sql, args)
+}
+
+// Get row in transaction
+func (t *Tx) Row(ptr interface{}, sql string, args ...interface{}) error {
+	return t.RowContext(context.Background(), ptr, sql, args...)
+}
+
+// Get row in transaction with context
+func (t *Tx) RowContext(ctx context.Context, ptr interface{}, sql string, args ...interface{}) error {
+	return t.Server.row(ctx, t.tx, ptr, sql, args)
+}
+
+// Get all rows in transaction
+func (t *Tx) Rows(ptr interface{}, sql string, args ...interface{}) error {
+	return t.RowsContext(context.Background(), ptr, sql, args...)
+}
+
+// Get all rows in transaction with context
+func (t *Tx) RowsContext(ctx context.Context, ptr interface{}, sql string, args ...interface{}) error {
+	return t.Server.allRows(ctx, t.tx, ptr, sql, args)
+}
+
+// Iterate rows in transaction
+func (t *Tx) Iter(sql string, args ...interface{}) (*Iter, error) {
+	return t.IterContext(context.Background(), sql, args...)
+}
+
+// Iterate rows in transaction with context
+func (t *Tx) IterContext(ctx context.Context, sql string, args ...interface{}) (*Iter, error) {
+	return t.Server.iter(ctx, t.tx, sql, args)
+}
+
+// Run a query returning several result sets in transaction
+func (t *Tx) Results(sql string, args ...interface{}) (*Results, error) {
+	return t.Server.results(context.Background(), t.tx, sql, args)
+}
+
+// Call a stored procedure in transaction
+func (t *Tx) Call(proc string, args ...interface{}) (*Results, error) {
+	str, err := t.Server.callSQL(proc, len(args))
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Results(str, args...)
+}
+
+// New query in transaction
+func (t *Tx) NewQuery() *Query {
+	q := NewQuery(t.Server)
+	q.Tx = t
+	return q
+}
+
+// Insert into
+func (t *Tx) InsertInto(tb string) *Query {
+	return t.NewQuery().InsertInto(tb)
+}
+
+// Update
+func (t *Tx) Update(tb string) *Query {
+	return t.NewQuery().Update(tb)
+}
+
+// Delete from
+func (t *Tx) DeleteFrom(tb string) *Query {
+	return t.NewQuery().DeleteFrom(tb)
+}
+
+// Select
+func (t *Tx) Select(f ...string) *Query {
+	return t.NewQuery().Select(f...)
+}
@@ -6,79 +6,405 @@ package db
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Type assertions
-func typeAssertion(v interface{}) interface{} {
-	switch v.(type) {
+// Layouts of date and time columns returned as text
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Convert a driver value by its column type: integers to int64 (uint64 if
+// too large), floats to float64, DECIMAL and NUMERIC to a decimal string,
+// BOOL to bool, DATE, DATETIME and TIMESTAMP to time.Time in UTC unless the
+// driver gives a zone, binary to []byte and everything else to string.
+// Values that do not parse are returned as string, NULL is nil.
+func typeAssertion(v interface{}, typeName string) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch columnKind(typeName) {
+	case "int":
+		switch x := v.(type) {
+		case []byte, string:
+			str := toString(x)
+			if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+				return i
+			}
+			if u, err := strconv.ParseUint(str, 10, 64); err == nil {
+				return u
+			}
+			return str
+		case float64:
+			if x == float64(int64(x)) {
+				return int64(x)
+			}
+		case bool:
+			if x {
+				return int64(1)
+			}
+			return int64(0)
+		}
+
+	case "float":
+		switch x := v.(type) {
+		case []byte, string:
+			if f, err := strconv.ParseFloat(toString(x), 64); err == nil {
+				return f
+			}
+			return toString(x)
+		case int64:
+			return float64(x)
+		case float32:
+			return float64(x)
+		}
+
+	case "decimal":
+		switch x := v.(type) {
+		case int64:
+			return strconv.FormatInt(x, 10)
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64)
+		}
+
+	case "bool":
+		switch x := v.(type) {
+		case int64:
+			return x != 0
+		case []byte, string:
+			if b, err := strconv.ParseBool(toString(x)); err == nil {
+				return b
+			}
+			return toString(x)
+		}
+
+	case "time":
+		switch x := v.(type) {
+		case []byte, string:
+			str := toString(x)
+			for _, layout := range timeLayouts {
+				if t, err := time.ParseInLocation(layout, str, time.UTC); err == nil {
+					return t
+				}
+			}
+			return str
+		}
+
+	case "bytes":
+		if x, ok := v.(string); ok {
+			return []byte(x)
+		}
+		return v
+	}
+
+	// Text and unknown types
+	switch x := v.(type) {
 	case []byte:
-		return v.([]byte)
+		return string(x)
 	case []rune:
-		return v.([]rune)
-	case bool:
-		return v.(bool)
-	case float64:
-		return v.(float64)
-	case int64:
-		return v.(int64)
-	case nil:
-		return nil
-	case string:
-		return v.(string)
-	default:
-		log.Printf("Unexpected type %#v\n", v)
+		return string(x)
+	}
+	return v
+}
+
+// Kind of column type name: int, float, decimal, bool, time, bytes or text
+func columnKind(typeName string) string {
+	t := strings.ToUpper(typeName)
+	if i := strings.IndexByte(t, '('); i >= 0 {
+		t = t[:i]
+	}
+	t = strings.TrimSpace(strings.TrimPrefix(t, "UNSIGNED "))
+
+	switch t {
+	case "":
 		return ""
+	case "BOOL", "BOOLEAN":
+		return "bool"
+	case "DATE", "DATETIME", "TIMESTAMP", "TIMESTAMPTZ", "TIMESTAMP WITH TIME ZONE", "TIMESTAMP WITHOUT TIME ZONE":
+		return "time"
+	case "DECIMAL", "NUMERIC", "MONEY":
+		return "decimal"
+	case "FLOAT", "FLOAT4", "FLOAT8", "DOUBLE", "DOUBLE PRECISION", "REAL":
+		return "float"
+	case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BINARY", "VARBINARY", "BYTEA":
+		return "bytes"
+	case "YEAR", "SERIAL", "BIGSERIAL", "SMALLSERIAL":
+		return "int"
+	case "INTERVAL", "POINT":
+		return "text"
+	}
+
+	if strings.Contains(t, "INT") {
+		return "int"
+	}
+	return "text"
+}
+
+// []byte or string to string
+func toString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
 	}
+	return v.(string)
 }
 
-// Get scan variables
-func scanVariables(ptr interface{}, columnsLen int, isRows bool) (reflect.Kind, interface{}, []interface{}, error) {
+// Scan targets of result rows
+type rowScanner struct {
+	// Row kind: struct, map or slice
+	kind reflect.Kind
+
+	// Row type
+	typ reflect.Type
+
+	// Result columns
+	columns []string
+
+	// Database type name of each column
+	types []string
+
+	// Struct field index of each column, nil if the column is ignored.
+	// A scalar row has one empty index, the row itself.
+	fields [][]int
+
+	// Field type of each column
+	fieldTypes []reflect.Type
+
+	// Error on NULL into a field that can not hold it, instead of zero value
+	strictNull bool
+
+	// Columns scanned through a pointer because the field can not hold NULL
+	nullable []bool
+
+	// Columns of db:",json" fields
+	jsons []bool
+
+	// Current row (struct, scalar)
+	row reflect.Value
+
+	// Current row (map, slice)
+	values []interface{}
+
+	// Current scan targets
+	scan []interface{}
+}
+
+// New row scanner, struct fields are matched to columns by name.
+// Scalars (int64, string, time.Time ...) take a single column.
+func newRowScanner(ptr interface{}, columns []string, types []string, isRows bool, ignoreUnknown bool, strictNull bool) (*rowScanner, error) {
 	typ := reflect.TypeOf(ptr)
-	if typ.Kind() != reflect.Ptr {
-		return 0, nil, nil, errors.New("ptr is not a pointer")
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return nil, errors.New("ptr is not a pointer")
 	}
 
 	elemTyp := typ.Elem()
 
 	if isRows { // Rows
 		if elemTyp.Kind() != reflect.Slice {
-			return 0, nil, nil, errors.New("ptr is not point a slice")
+			return nil, errors.New("ptr is not point a slice")
 		}
 
 		elemTyp = elemTyp.Elem()
 	}
 
-	elemKind := elemTyp.Kind()
+	s := &rowScanner{kind: elemTyp.Kind(), typ: elemTyp, columns: columns, types: types, strictNull: strictNull, scan: make([]interface{}, len(columns))}
+
+	switch {
+	case isScalarType(elemTyp):
+		if len(columns) != 1 {
+			return nil, fmt.Errorf("%d columns can not be scanned into %s", len(columns), elemTyp)
+		}
+		s.fields = [][]int{[]int{}}
+		s.fieldTypes = []reflect.Type{elemTyp}
+		s.nullable = []bool{!canHoldNull(elemTyp)}
+
+	case s.kind == reflect.Struct:
+		indexes := fieldIndexes(elemTyp)
+		s.fields = make([][]int, len(columns))
+		s.fieldTypes = make([]reflect.Type, len(columns))
+		s.nullable = make([]bool, len(columns))
+		s.jsons = make([]bool, len(columns))
+		for i, c := range columns {
+			idx, ok := indexes[strings.ToLower(c)]
+			if !ok && !ignoreUnknown {
+				return nil, fmt.Errorf("column %s has no matching field in %s", c, elemTyp)
+			}
+			s.fields[i] = idx
+			if ok {
+				sf := elemTyp.FieldByIndex(idx)
+				_, options := parseTag(sf.Tag.Get("db"))
+				s.fieldTypes[i] = sf.Type
+				s.jsons[i] = isJSON(options)
+				s.nullable[i] = !s.jsons[i] && !canHoldNull(s.fieldTypes[i])
+			}
+		}
+
+	case s.kind == reflect.Map, s.kind == reflect.Slice:
+
+	default:
+		return nil, errors.New("ptr is not a point struct, map, slice or scalar")
+	}
+
+	return s, nil
+}
+
+// Allocate a new row, return its scan targets
+func (s *rowScanner) targets() []interface{} {
+	if s.fields != nil { // struct, scalar
+		s.row = reflect.New(s.typ).Elem()
+		for i, idx := range s.fields {
+			if idx == nil {
+				s.scan[i] = new(interface{})
+			} else if s.jsons != nil && s.jsons[i] {
+				s.scan[i] = jsonScanner{fieldByIndex(s.row, idx)}
+			} else if s.nullable[i] {
+				// *T field -> **T target, NULL leaves it nil
+				s.scan[i] = reflect.New(reflect.PtrTo(s.fieldTypes[i])).Interface()
+			} else {
+				s.scan[i] = fieldByIndex(s.row, idx).Addr().Interface()
+			}
+		}
+		return s.scan
+	}
+
+	s.values = make([]interface{}, len(s.columns))
+	for i := range s.values {
+		s.scan[i] = &s.values[i]
+	}
+	return s.scan
+}
+
+// Current row, after scan
+func (s *rowScanner) value() (reflect.Value, error) {
+	switch {
+	case s.fields != nil: // struct, scalar
+		for i, ok := range s.nullable {
+			if !ok {
+				continue
+			}
+
+			p := reflect.ValueOf(s.scan[i]).Elem()
+			if p.IsNil() {
+				if s.strictNull {
+					return s.row, fmt.Errorf("column %s is NULL, %s can not hold it", s.columns[i], p.Type().Elem())
+				}
+				continue // zero value
+			}
+			fieldByIndex(s.row, s.fields[i]).Set(p.Elem())
+		}
+		return s.row, nil
 
-	// element(value) is point to row
-	scan := make([]interface{}, columnsLen)
+	case s.kind == reflect.Map: // map
+		row := make(map[string]interface{}, len(s.columns))
+		for i, c := range s.columns {
+			row[c] = typeAssertion(s.values[i], s.types[i])
+		}
+		return reflect.ValueOf(row), nil
 
-	if elemKind == reflect.Struct {
-		if columnsLen != elemTyp.NumField() {
-			return 0, nil, nil, errors.New("columnsLen is not equal elemTyp.NumField()")
+	default: // slice
+		row := make([]interface{}, len(s.columns))
+		for i, v := range s.values {
+			row[i] = typeAssertion(v, s.types[i])
 		}
+		return reflect.ValueOf(row), nil
+	}
+}
+
+// Types scanned from a single column: basic types, []byte, time.Time,
+// sql.Scanner and pointers to them
+func isScalarType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Struct:
+		return isValueType(t)
+	}
+	return false
+}
+
+// Field types that take NULL as is: pointers, sql.Scanner, interface{}, []byte
+func canHoldNull(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return true
+	}
+	return reflect.PtrTo(t).Implements(scannerType)
+}
 
-		row := reflect.New(elemTyp) // Data
-		for i := 0; i < columnsLen; i++ {
-			f := elemTyp.Field(i)
-			if !f.Anonymous { // && f.Tag.Get("field") != ""
-				scan[i] = row.Elem().FieldByIndex([]int{i}).Addr().Interface()
+// Field by index, nil embedded or nested struct pointers on the way are allocated
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
 			}
+			v = v.Elem()
 		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// Column name (lower case) to struct field index.
+// A field matches its field tag, json tag or name, in this order of precedence.
+// Fields of nested structs match "Parent.Child" column aliases.
+func fieldIndexes(typ reflect.Type) map[string][]int {
+	return nestedIndexes(typ, map[reflect.Type]bool{})
+}
+
+// Field indexes of typ, visited guards against recursive types
+func nestedIndexes(typ reflect.Type, visited map[reflect.Type]bool) map[string][]int {
+	visited[typ] = true
+	defer delete(visited, typ)
 
-		return elemKind, row.Interface(), scan, nil
+	indexes := make(map[string][]int)
+	fields := structFields(typ)
+	for pass := 0; pass < 3; pass++ {
+		for _, f := range fields {
+			name := f.names()[pass]
+			if _, ok := indexes[name]; !ok && name != "" {
+				indexes[name] = f.Index
+			}
+		}
 	}
 
-	if elemKind == reflect.Map || elemKind == reflect.Slice {
-		row := make([]interface{}, columnsLen) // Data
-		for i := 0; i < columnsLen; i++ {
-			scan[i] = &row[i]
+	for _, f := range fields {
+		if !f.Nested {
+			continue
+		}
+
+		ft := f.Field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.Struct || visited[ft] {
+			continue
 		}
 
-		return elemKind, &row, scan, nil
+		for k, v := range nestedIndexes(ft, visited) {
+			for _, name := range f.names() {
+				if _, ok := indexes[name+"."+k]; !ok && name != "" {
+					indexes[name+"."+k] = append(append([]int{}, f.Index...), v...)
+				}
+			}
+		}
 	}
 
-	return 0, nil, nil, errors.New("ptr is not a point struct, map or slice")
+	return indexes
 }
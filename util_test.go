@@ -0,0 +1,46 @@
+// Copyright 2014 The zhgo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestTypeAssertion(t *testing.T) {
+    tm := time.Date(2015, 1, 17, 1, 2, 3, 0, time.UTC)
+    cases := []struct {
+        v    interface{}
+        typ  string
+        want interface{}
+    }{
+        {nil, "INT", nil},
+        {[]byte("1980"), "YEAR", int64(1980)},
+        {[]byte("18446744073709551615"), "UNSIGNED BIGINT", uint64(18446744073709551615)},
+        {int64(7), "INT4", int64(7)},
+        {[]byte("1.5"), "DOUBLE", 1.5},
+        {int64(2), "REAL", float64(2)},
+        {[]byte("12.30"), "DECIMAL", "12.30"},
+        {float64(12.3), "NUMERIC", "12.3"},
+        {int64(1), "BOOLEAN", true},
+        {[]byte("t"), "BOOL", true},
+        {[]byte("2015-01-17 01:02:03"), "TIMESTAMP", tm},
+        {"2015-01-17T01:02:03Z", "DATETIME", tm},
+        {tm, "TIMESTAMPTZ", tm},
+        {[]byte("0000-00-00 00:00:00"), "DATETIME", "0000-00-00 00:00:00"},
+        {"\x00\x01", "BYTEA", []byte("\x00\x01")},
+        {[]byte("Male"), "CHAR", "Male"},
+        {[]byte("Bob"), "VARCHAR(16)", "Bob"},
+        {[]byte("Bob"), "", "Bob"},
+        {int64(3), "", int64(3)},
+        {[]byte("1 day"), "INTERVAL", "1 day"},
+    }
+    for _, c := range cases {
+        if got := typeAssertion(c.v, c.typ); !reflect.DeepEqual(got, c.want) {
+            t.Fatalf("typeAssertion(%#v, %q): %#v, want %#v\n", c.v, c.typ, got, c.want)
+        }
+    }
+}